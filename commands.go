@@ -0,0 +1,297 @@
+package main
+
+// commands.go includes the implementation of each vaultexec subcommand.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/funnylookinhat/vaultexec/pkg/vaultexec"
+)
+
+// runExec fetches the secrets and runs the command with them, renewing the
+// token for as long as the command runs.
+func runExec(flagConfig vaultexec.VaultConfig, options Options, cmd []string) {
+	if len(options.MetricsAddr) > 0 {
+		errCheck(vaultexec.ServeMetrics(options.MetricsAddr), ExitConfigError)
+	}
+
+	if len(options.HealthAddr) > 0 {
+		errCheck(vaultexec.ServeHealth(options.HealthAddr), ExitConfigError)
+	}
+
+	// The dependencies are waited for before fetching, so that the leases of
+	// dynamic secrets don't run down while waiting.
+	if len(options.WaitFor) > 0 && !options.DryRun {
+		dependencies, err := vaultexec.ParseDependencies(options.WaitFor)
+		errCheck(err, ExitConfigError)
+		errCheck(vaultexec.WaitForDependencies(dependencies, options.WaitTimeout), ExitFetchError)
+	}
+
+	// If the startup deadline passed, the command may be run without vault,
+	// see startExec.
+	config, vaultSecrets, connected := startExec(flagConfig, options, cmd)
+
+	if options.DryRun {
+		vaultexec.PrintSecretSources(os.Stdout, vaultSecrets)
+		return
+	}
+
+	auditSecrets(options, vaultSecrets, "inject", cmd)
+
+	if !options.SkipCIMask {
+		vaultexec.MaskSecretsInCI(os.Stderr, vaultSecrets.Values)
+	}
+
+	// Renew the token periodically (half of every lease duration), starting
+	// right now.
+	if connected {
+		go vaultexec.KeepVaultTokenRenewed(config, options.RenewIncrement)
+	}
+
+	// This is a blocking call that runs several go-funcs to manage sending
+	// signals to the process.
+	runErr := vaultexec.RunWithEnvVars(cmd, vaultSecrets.Values)
+
+	// Revoke any dynamic secrets so that short-lived commands don't leave live
+	// credentials behind for the remainder of their TTL.
+	if connected && options.RevokeLeasesOnExit {
+		for _, leaseID := range vaultSecrets.LeaseIDs {
+			err := vaultexec.RevokeVaultLease(leaseID, config)
+			if err != nil {
+				vaultexec.LogErrorf("error revoking vault lease %s: %s", leaseID, err)
+			}
+		}
+	}
+
+	// The command's own exit code is passed on, see exitCode.
+	errCheck(runErr, ExitCannotExecute)
+}
+
+// connectToVault loads the vault config, and waits for vault to be ready if
+// requested.
+func connectToVault(flagConfig vaultexec.VaultConfig, options Options, cmd []string, requirePath bool) (vaultexec.VaultConfig, error) {
+	config, err := loadVaultConfig(flagConfig, options, cmd, requirePath)
+	if err != nil {
+		return config, &exitError{err, ExitConfigError}
+	}
+
+	if options.WaitForVault > 0 {
+		err = vaultexec.WaitForVault(config, options.WaitForVault, options.WaitForVaultActive)
+		if err != nil {
+			return config, &exitError{err, ExitFetchError}
+		}
+	}
+
+	return config, nil
+}
+
+// fetchCheckedSecrets checks that the token can read every path before
+// fetching the secrets, then checks them against -require and -value-rule.
+func fetchCheckedSecrets(config vaultexec.VaultConfig, options Options) (vaultexec.VaultSecrets, error) {
+	err := checkCapabilities(config, options)
+	if err != nil {
+		return vaultexec.VaultSecrets{}, err
+	}
+
+	vaultSecrets, err := getSecrets(config, options)
+	if err != nil {
+		return vaultSecrets, &exitError{err, ExitFetchError}
+	}
+
+	return vaultSecrets, checkSecrets(vaultSecrets, options)
+}
+
+// checkSecrets checks that the secrets have every required key, and values
+// that match every rule.
+func checkSecrets(vaultSecrets vaultexec.VaultSecrets, options Options) error {
+	err := vaultexec.CheckRequiredKeys(vaultSecrets, *options.Require)
+	if err == nil {
+		err = vaultexec.CheckValueRules(vaultSecrets, *options.ValueRules)
+	}
+	if err != nil {
+		return &exitError{err, ExitFetchError}
+	}
+	return nil
+}
+
+// checkCapabilities checks that the token can read every path, unless the check
+// was skipped, so that a missing policy is reported precisely rather than as
+// a permission denied error part way through fetching.  If stale secrets are
+// allowed, failing to check (e.g. because vault is unreachable) is left for
+// fetching the secrets to deal with.
+func checkCapabilities(config vaultexec.VaultConfig, options Options) error {
+	if options.SkipCapabilityCheck {
+		return nil
+	}
+
+	err := vaultexec.CheckVaultCapabilities(config)
+	switch err.(type) {
+	case nil:
+		return nil
+	case *vaultexec.CapabilityError:
+		return &exitError{err, ExitAuthError}
+	case *vaultexec.VaultAuthError:
+		vaultexec.LogErrorf("unable to check token capabilities, use -skip-capability-check if the token can't use sys/capabilities-self")
+		return &exitError{err, ExitAuthError}
+	}
+
+	if options.SecretCache.AllowStale > 0 {
+		vaultexec.LogWarnf("Skipping the capability check: %s", err)
+		return nil
+	}
+	return &exitError{err, ExitFetchError}
+}
+
+// getSecrets fetches the secrets, through the secret cache if there is one.
+func getSecrets(config vaultexec.VaultConfig, options Options) (vaultexec.VaultSecrets, error) {
+	if len(options.SecretCache.File) > 0 {
+		return vaultexec.GetVaultSecretsWithCache(config, options.SecretCache)
+	}
+	return vaultexec.GetVaultSecrets(config)
+}
+
+// auditSecrets writes a record of the secrets being used to the audit log, if
+// one was requested.  The secrets must not be used if this fails.
+func auditSecrets(options Options, vaultSecrets vaultexec.VaultSecrets, event string, cmd []string) {
+	if len(options.AuditLog) == 0 {
+		return
+	}
+
+	auditLog, err := vaultexec.OpenAuditLog(options.AuditLog)
+	errCheck(err, ExitConfigError)
+	defer auditLog.Close()
+
+	errCheck(vaultexec.WriteAuditLog(auditLog, vaultSecrets, event, cmd), ExitConfigError)
+}
+
+// runFetch prints the merged secrets to stdout in the requested format.
+func runFetch(config vaultexec.VaultConfig, options Options) {
+	vaultSecrets, err := fetchCheckedSecrets(config, options)
+	errCheck(err, ExitFetchError)
+
+	if options.DryRun {
+		vaultexec.PrintSecretSources(os.Stdout, vaultSecrets)
+		return
+	}
+
+	auditSecrets(options, vaultSecrets, "output", nil)
+
+	// The masks go to stderr, so that the output can still be sourced.
+	if !options.SkipCIMask {
+		vaultexec.MaskSecretsInCI(os.Stderr, vaultSecrets.Values)
+	}
+
+	switch options.Format {
+	case "env":
+		keys := make([]string, 0, len(vaultSecrets.Values))
+		for k := range vaultSecrets.Values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		// The output is sourced or eval'd, so a key from vault mustn't be able
+		// to inject shell commands.
+		var invalid []string
+		for _, k := range keys {
+			if !vaultexec.IsShellVariableName(k) {
+				invalid = append(invalid, fmt.Sprintf("%q (from %s)", k, vaultSecrets.Sources[k]))
+			}
+		}
+		if len(invalid) > 0 {
+			errCheck(fmt.Errorf("invalid variable names for the env format: %s, use -sanitize to replace invalid characters", strings.Join(invalid, ", ")), ExitFetchError)
+		}
+
+		for _, k := range keys {
+			fmt.Printf("%s=%s\n", k, vaultexec.QuoteCommandLine([]string{vaultexec.EnvValue(vaultSecrets.Values[k])}))
+		}
+	case "json", "terraform":
+		// Terraform's external data source reads the same flat object of
+		// strings.
+		values := make(map[string]string, len(vaultSecrets.Values))
+		for k, v := range vaultSecrets.Values {
+			values[k] = vaultexec.EnvValue(v)
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		errCheck(encoder.Encode(values), ExitFetchError)
+	case "exec-credential":
+		token, ok := vaultSecrets.Values[options.ExecCredentialKey]
+		if !ok {
+			errCheck(fmt.Errorf("no %s key in the secrets for the exec credential token, see -exec-credential-key", options.ExecCredentialKey), ExitFetchError)
+		}
+
+		credential, err := vaultexec.NewExecCredential(vaultexec.EnvValue(token))
+		errCheck(err, ExitConfigError)
+		errCheck(json.NewEncoder(os.Stdout).Encode(credential), ExitFetchError)
+	default:
+		errCheck(fmt.Errorf("unknown format %s, must be env, json, exec-credential, or terraform", options.Format), ExitConfigError)
+	}
+}
+
+// applyTerraformQuery reads the query of Terraform's external data source
+// from r, a JSON object of strings, and uses its path (if it has one) as
+// the secret path, so that one data source can be declared per path.
+func applyTerraformQuery(r io.Reader, flagConfig *vaultexec.VaultConfig) error {
+	queryBytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error reading the terraform query: %s", err)
+	}
+
+	query := map[string]string{}
+	if len(queryBytes) > 0 {
+		err = json.Unmarshal(queryBytes, &query)
+		if err != nil {
+			return fmt.Errorf("invalid terraform query, must be an object of strings: %s", err)
+		}
+	}
+
+	for k, v := range query {
+		switch k {
+		case "path":
+			flagConfig.Path = v
+		case "path_delim":
+			flagConfig.PathDelim = v
+		default:
+			return fmt.Errorf("unknown terraform query key %s, must be path or path_delim", k)
+		}
+	}
+
+	return nil
+}
+
+// runRenew renews the token once and prints the new lease duration.
+func runRenew(config vaultexec.VaultConfig, options Options) {
+	leaseDuration, err := vaultexec.RenewVaultToken(config, options.RenewIncrement)
+	errCheck(err, ExitFetchError)
+
+	fmt.Printf("token renewed, lease duration %s\n", time.Duration(leaseDuration)*time.Second)
+}
+
+// validateExitCodes maps each kind of problem found by validate to the exit
+// code for it.
+var validateExitCodes = map[string]int{
+	vaultexec.ConfigProblem: ExitConfigError,
+	vaultexec.AuthProblem:   ExitAuthError,
+	vaultexec.FetchProblem:  ExitFetchError,
+}
+
+// runValidate checks the configuration, token, and every path, printing any
+// problems and exiting with the exit code for the first one if there are any.
+func runValidate(config vaultexec.VaultConfig) {
+	problems := vaultexec.ValidateVaultSetup(config)
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "vaultexec validate: %s\n", vaultexec.Redact(problem.Message))
+	}
+	if len(problems) > 0 {
+		os.Exit(validateExitCodes[problems[0].Kind])
+	}
+	fmt.Println("vaultexec validate: OK")
+}
@@ -0,0 +1,504 @@
+package main
+
+// config.go includes functions for loading vaultexec options from a config
+// file.  A config file declares options using the same names as the command
+// line options, e.g.:
+//
+//     address: https://path.to.vault:8200
+//     path: secret/my-app/all,secret/shared/all
+//     header:
+//       - "X-Custom: value"
+//
+// Named profiles can be declared under "profiles", each with its own options
+// that take precedence over those at the top level when selected with
+// -profile:
+//
+//     profiles:
+//       staging:
+//         address: https://vault.staging:8200
+//
+// Every option can also be provided by a VAULTEXEC_ environment variable named
+// after it, e.g. VAULTEXEC_LOG_LEVEL for -log-level.
+//
+// Options are taken from, in order of precedence: the command line, VAULTEXEC_
+// environment variables, VAULT_ environment variables, and the config file.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/funnylookinhat/vaultexec/pkg/vaultexec"
+)
+
+// optionEnvVars maps the name of each option to the environment variable that
+// can also provide it.
+var optionEnvVars = map[string]string{
+	"address":          "VAULT_ADDR",
+	"token":            "VAULT_TOKEN",
+	"path":             "VAULT_PATH",
+	"path-delim":       "VAULT_PATH_DELIM",
+	"ca-cert":          "VAULT_CACERT",
+	"ca-path":          "VAULT_CAPATH",
+	"client-cert":      "VAULT_CLIENT_CERT",
+	"client-key":       "VAULT_CLIENT_KEY",
+	"tls-skip-verify":  "VAULT_SKIP_VERIFY",
+	"tls-server-name":  "VAULT_TLS_SERVER_NAME",
+	"proxy":            "VAULT_HTTP_PROXY",
+	"request-timeout":  "VAULT_CLIENT_TIMEOUT",
+	"max-retries":      "VAULT_MAX_RETRIES",
+	"rate-limit":       "VAULT_RATE_LIMIT",
+	"rate-limit-burst": "VAULT_RATE_LIMIT",
+	"vault-index":      "VAULT_INDEX",
+}
+
+// optionEnvVar returns the name of the VAULTEXEC_ environment variable for an
+// option, e.g. VAULTEXEC_LOG_LEVEL for log-level.
+func optionEnvVar(name string) string {
+	return "VAULTEXEC_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// ApplyEnvOptions sets every option that wasn't provided on the command line
+// from its VAULTEXEC_ environment variable, if set.  Repeatable options (e.g.
+// header) can be given several values separated by newlines.
+func ApplyEnvOptions(flagSet *flag.FlagSet) error {
+	provided := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		provided[f.Name] = true
+	})
+
+	var err error
+	flagSet.VisitAll(func(f *flag.Flag) {
+		envVar := optionEnvVar(f.Name)
+		value := os.Getenv(envVar)
+		if err != nil || provided[f.Name] || len(value) == 0 {
+			return
+		}
+
+		values := []string{value}
+		if _, ok := f.Value.(repeatableValue); ok {
+			values = strings.Split(value, "\n")
+		}
+
+		for _, v := range values {
+			if setErr := flagSet.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value for %s: %s", envVar, setErr)
+				return
+			}
+		}
+	})
+
+	return err
+}
+
+// repeatableValue is implemented by options that can be provided more than
+// once, which may be given a list of values in a config file.
+type repeatableValue interface {
+	flag.Value
+	repeatable()
+}
+
+// The names of project config files, which are discovered automatically in
+// the working directory or any of its parents.
+var projectConfigFiles = []string{".vaultexec", ".vaultexec.yml", ".vaultexec.yaml", ".vaultexec.json"}
+
+// FindProjectConfigFile looks for a project config file in dir and each of
+// its parents up to the repository root (a directory with .git) or the home
+// directory, returning the path of the closest one or an empty string if
+// there is none.  A file that another user could have written (see
+// checkProjectConfigOwner) is ignored with a warning.
+func FindProjectConfigFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+
+	if err != nil {
+		return "", err
+	}
+
+	home, _ := os.UserHomeDir()
+
+	for {
+		for _, name := range projectConfigFiles {
+			path := filepath.Join(dir, name)
+			fileInfo, err := os.Stat(path)
+			if err != nil || fileInfo.IsDir() {
+				continue
+			}
+
+			err = checkProjectConfigOwner(path)
+			if err == nil {
+				err = checkProjectConfigOwner(dir)
+			}
+			if err != nil {
+				vaultexec.LogWarnf("Ignoring the project config file %s: %s", path, err)
+				return "", nil
+			}
+
+			return path, nil
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil || dir == home {
+			return "", nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// Options that a project config file found by FindProjectConfigFile can't
+// set, since they run commands, or change where the token and secrets are
+// sent or stored.  They can still be set in a config file given with -config.
+var projectConfigDeniedOptions = []string{
+	"address", "proxy", "header", "allow-vault-host",
+	"ca-cert", "ca-path", "tls-skip-verify", "tls-server-name",
+	"generate-config", "generate-config-shell", "generate-config-cache",
+	"source-plugin", "http-source",
+	"notify-command", "notify-webhook",
+	"secret-cache", "secret-cache-key",
+}
+
+// ConfigFile holds the options declared in a config file.
+type ConfigFile struct {
+	Path    string
+	Options map[string]interface{}
+
+	// The line each key was declared on by its dotted path, e.g.
+	// profiles.staging.address (for YAML files only).
+	lines map[string]int
+}
+
+// location describes where the key with the given dotted path was declared,
+// for error messages.
+func (c *ConfigFile) location(key string) string {
+	if line, ok := c.lines[key]; ok {
+		return fmt.Sprintf("%s line %d", c.Path, line)
+	}
+	return fmt.Sprintf("%s (%s)", c.Path, key)
+}
+
+// configOption is an option selected from a config file.
+type configOption struct {
+	value interface{}
+	key   string // The dotted path it was declared at
+}
+
+// LoadConfigFile reads a config file, which is parsed as JSON if it has a
+// .json extension or starts with "{", and as YAML otherwise.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	fileBytes, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %s", err)
+	}
+
+	file := &ConfigFile{Path: path}
+
+	if filepath.Ext(path) == ".json" || bytes.HasPrefix(bytes.TrimSpace(fileBytes), []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(fileBytes))
+		decoder.UseNumber()
+		err = decoder.Decode(&file.Options)
+	} else {
+		file.Options, file.lines, err = parseYAML(fileBytes)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %s", path, err)
+	}
+
+	return file, nil
+}
+
+// configFileProfiles returns the profiles declared in a config file.
+func configFileProfiles(file *ConfigFile) (map[string]map[string]interface{}, error) {
+	profiles := map[string]map[string]interface{}{}
+
+	value, ok := file.Options["profiles"]
+	if !ok {
+		return profiles, nil
+	}
+
+	mapping, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: profiles must be a mapping of profile names to options", file.location("profiles"))
+	}
+
+	for name, value := range mapping {
+		profileOptions, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: profile %s must be a mapping of options", file.location("profiles."+name), name)
+		}
+		profiles[name] = profileOptions
+	}
+
+	return profiles, nil
+}
+
+// ValidateConfigFile checks that every option declared in a config file,
+// including those of every profile, is a known option with a value of the
+// right type.  Errors give the line of the offending option where possible,
+// and suggest the option that was probably meant for unknown ones.
+func ValidateConfigFile(flagSet *flag.FlagSet, file *ConfigFile) error {
+	profiles, err := configFileProfiles(file)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "profile" {
+			names = append(names, f.Name)
+		}
+	})
+
+	check := func(prefix string, options map[string]interface{}) error {
+		keys := make([]string, 0, len(options))
+		for name := range options {
+			keys = append(keys, name)
+		}
+		sort.Strings(keys)
+
+		for _, name := range keys {
+			if len(prefix) == 0 && name == "profiles" {
+				continue
+			}
+
+			err := validateConfigOption(flagSet, name, options[name])
+			if err == errUnknownConfigOption {
+				err = fmt.Errorf("unknown option %s", name)
+				if suggestion := vaultexec.ClosestName(name, names); len(suggestion) > 0 {
+					err = fmt.Errorf("unknown option %s (did you mean %s?)", name, suggestion)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", file.location(prefix+name), err)
+			}
+		}
+		return nil
+	}
+
+	err = check("", file.Options)
+	if err != nil {
+		return err
+	}
+
+	profileNames := make([]string, 0, len(profiles))
+	for name := range profiles {
+		profileNames = append(profileNames, name)
+	}
+	sort.Strings(profileNames)
+
+	for _, name := range profileNames {
+		err = check("profiles."+name+".", profiles[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var errUnknownConfigOption = errors.New("unknown option")
+
+// validateConfigOption checks that a value from a config file can be used for
+// the named option.
+func validateConfigOption(flagSet *flag.FlagSet, name string, value interface{}) error {
+	f := flagSet.Lookup(name)
+	if f == nil || name == "config" || name == "profile" {
+		return errUnknownConfigOption
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	} else if _, ok := f.Value.(repeatableValue); !ok {
+		return fmt.Errorf("option %s must be a single value, not a list", name)
+	}
+
+	for _, v := range values {
+		s, err := configValueString(v)
+		if err != nil {
+			return fmt.Errorf("option %s %s", name, err)
+		}
+
+		if expected, ok := checkOptionValueType(f, s); !ok {
+			return fmt.Errorf("invalid value %q for option %s, must be %s", s, name, expected)
+		}
+	}
+
+	return nil
+}
+
+// checkOptionValueType checks that a value can be parsed for the option's
+// type, returning a description of the type if it can't be.
+func checkOptionValueType(f *flag.Flag, value string) (string, bool) {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return "", true
+	}
+
+	var err error
+	var expected string
+	switch getter.Get().(type) {
+	case bool:
+		_, err = strconv.ParseBool(value)
+		expected = "true or false"
+	case int:
+		_, err = strconv.Atoi(value)
+		expected = "a whole number"
+	case float64:
+		_, err = strconv.ParseFloat(value, 64)
+		expected = "a number"
+	case time.Duration:
+		_, err = time.ParseDuration(value)
+		expected = "a duration, e.g. 30s or 5m"
+	}
+
+	return expected, err == nil
+}
+
+// SelectConfigProfile returns the options from a config file with those of the
+// named profile merged over the top level ones.  If profile is empty only the
+// top level options are returned.
+func SelectConfigProfile(file *ConfigFile, profile string) (map[string]configOption, error) {
+	selected := map[string]configOption{}
+
+	for name, value := range file.Options {
+		if name != "profiles" {
+			selected[name] = configOption{value: value, key: name}
+		}
+	}
+
+	profiles, err := configFileProfiles(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(profile) == 0 {
+		return selected, nil
+	}
+
+	profileOptions, ok := profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("profile %s not found in config file %s", profile, file.Path)
+	}
+
+	for name, value := range profileOptions {
+		selected[name] = configOption{value: value, key: "profiles." + profile + "." + name}
+	}
+
+	return selected, nil
+}
+
+// ApplyConfigFile sets every option selected from the config file, unless it
+// was provided on the command line or by its environment variable.  The
+// config file must have passed ValidateConfigFile.  Returns where each option
+// that was set was declared.
+func ApplyConfigFile(flagSet *flag.FlagSet, file *ConfigFile, options map[string]configOption) (map[string]string, error) {
+	provided := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		provided[f.Name] = true
+	})
+
+	sources := map[string]string{}
+
+	for name, option := range options {
+		if provided[name] || len(os.Getenv(optionEnvVars[name])) > 0 {
+			continue
+		}
+
+		values, ok := option.value.([]interface{})
+		if !ok {
+			values = []interface{}{option.value}
+		}
+
+		for _, v := range values {
+			s, err := configValueString(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: option %s %s", file.location(option.key), name, err)
+			}
+
+			err = flagSet.Set(name, s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid value for option %s: %s", file.location(option.key), name, err)
+			}
+		}
+
+		sources[name] = file.location(option.key)
+		vaultexec.LogDebugf("Using option %s from %s", name, sources[name])
+	}
+
+	return sources, nil
+}
+
+// Options that can't be used together.
+var conflictingOptions = [][2]string{
+	{"log-file", "log-syslog"},
+}
+
+// Options that only have an effect along with another option.
+var dependentOptions = [][2]string{
+	{"generate-config-shell", "generate-config"},
+	{"generate-config-cache", "generate-config"},
+	{"generate-config-ttl", "generate-config-cache"},
+	{"wait-for-vault-active", "wait-for-vault"},
+	{"wait-timeout", "wait-for"},
+	{"statsd-prefix", "statsd-addr"},
+	{"statsd-tag", "statsd-addr"},
+	{"secret-cache", "secret-cache-key"},
+	{"secret-cache-key", "secret-cache"},
+	{"allow-stale", "secret-cache"},
+	{"startup-timeout-policy", "startup-timeout"},
+	{"nomad-auth-mount", "nomad"},
+	{"nomad-role", "nomad"},
+}
+
+// CheckOptionCombinations checks that no options that can't be used together
+// have been set, and that options which depend on another aren't set without
+// it.  sources describes where each option was set, for error messages.
+func CheckOptionCombinations(flagSet *flag.FlagSet, sources map[string]string) error {
+	set := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for _, options := range conflictingOptions {
+		if set[options[0]] && set[options[1]] {
+			return fmt.Errorf("-%s (from %s) and -%s (from %s) can't be used together",
+				options[0], sources[options[0]], options[1], sources[options[1]])
+		}
+	}
+
+	for _, options := range dependentOptions {
+		if set[options[0]] && !set[options[1]] {
+			return fmt.Errorf("-%s (from %s) requires -%s", options[0], sources[options[0]], options[1])
+		}
+	}
+
+	return nil
+}
+
+// configValueString converts a scalar config file value to the string that
+// would be given on the command line.
+func configValueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("must be a string, number, or boolean")
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// checkProjectConfigOwner returns an error unless path (a project config file
+// or its directory) is owned by the current user and isn't writable by its
+// group or others, since otherwise another user could have written it.
+func checkProjectConfigOwner(path string) error {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return errors.New(path + " isn't owned by the current user")
+	}
+
+	if fileInfo.Mode().Perm()&0022 != 0 {
+		return errors.New(path + " is writable by other users")
+	}
+
+	return nil
+}
@@ -0,0 +1,7 @@
+package main
+
+// checkProjectConfigOwner does nothing, since files on windows are protected
+// by ACLs rather than an owner and mode.
+func checkProjectConfigOwner(path string) error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+// exitcode.go defines the exit codes vaultexec uses, so that whatever runs it
+// can tell vaultexec's own failures (e.g. vault being down) apart from the
+// command failing.
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/funnylookinhat/vaultexec/pkg/vaultexec"
+)
+
+// Exit codes.  When the command runs, vaultexec exits with the command's own
+// exit code instead (or 128 plus the signal number if it was killed).
+const (
+	ExitConfigError     = 111 // Invalid options, config file, or generate-config output
+	ExitAuthError       = 112 // Vault rejected the token, or it can't read a path
+	ExitFetchError      = 113 // Vault couldn't be reached, or reading the secrets failed
+	ExitCannotExecute   = 126 // The command was found but couldn't be run
+	ExitCommandNotFound = 127 // The command wasn't found
+)
+
+// exitError is an error along with the code vaultexec should exit with for
+// it, for errors that are returned (e.g. from a goroutine) rather than passed
+// straight to errCheck.
+type exitError struct {
+	err  error
+	code int
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// exitCode returns the code vaultexec should exit with for err, which is code
+// unless err is an authentication failure or came from running the command.
+func exitCode(err error, code int) int {
+	switch e := err.(type) {
+	case *exitError:
+		return exitCode(e.err, e.code)
+	case *vaultexec.VaultAuthError:
+		return ExitAuthError
+	case *vaultexec.CommandError:
+		return commandExitCode(e.Err, code)
+	}
+	return code
+}
+
+// commandExitCode returns the code vaultexec should exit with when the command
+// couldn't be started, or exited unsuccessfully.
+func commandExitCode(err error, code int) int {
+	switch e := err.(type) {
+	case *exec.Error:
+		if e.Err == exec.ErrNotFound {
+			return ExitCommandNotFound
+		}
+		return ExitCannotExecute
+	case *os.PathError:
+		// Starting a command by path (e.g. ./run.sh) that doesn't exist or
+		// isn't executable.
+		if os.IsNotExist(e) {
+			return ExitCommandNotFound
+		}
+		return ExitCannotExecute
+	case *exec.ExitError:
+		if status, ok := e.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return e.ExitCode()
+	}
+	return code
+}
+
+// errCheck exits with the appropriate exit code if err is set, using code
+// unless the error calls for a more specific one (see exitCode).
+func errCheck(err error, code int) {
+	if err == nil {
+		return
+	}
+
+	// The command has already reported its own failure.
+	exited := false
+	if commandErr, ok := err.(*vaultexec.CommandError); ok {
+		_, exited = commandErr.Err.(*exec.ExitError)
+	}
+	if !exited {
+		vaultexec.LogErrorf("%s", err)
+	}
+
+	os.Exit(exitCode(err, code))
+}
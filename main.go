@@ -4,91 +4,617 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/funnylookinhat/vaultexec/pkg/vaultexec"
 )
 
-// Simple function to clean up golang error checking for main()
-func errCheck(err error) {
+// Version is the version of vaultexec, set at build time with
+// -ldflags "-X main.Version=v1.2.3".
+var Version = "dev"
+
+// Subcommands, the first of which is the default when none is given.
+var subcommands = []string{"exec", "fetch", "renew", "validate", "version"}
+
+// Options are the command line options that aren't part of the VaultConfig.
+type Options struct {
+	ConfigFile          string
+	Profile             string
+	GenerateConfig      vaultexec.GenerateConfigOptions
+	SecretCache         vaultexec.SecretCacheOptions
+	StartupTimeout      time.Duration
+	StartupPolicy       string
+	WaitForVault        time.Duration
+	WaitForVaultActive  bool
+	WaitFor             string
+	WaitTimeout         time.Duration
+	RenewIncrement      time.Duration
+	DryRun              bool
+	RevokeLeasesOnExit  bool
+	Format              string
+	ExecCredentialKey   string
+	LogLevel            string
+	Quiet               bool
+	LogFile             string
+	LogSyslog           bool
+	SourcePlugins       sourcePluginFlag
+	HTTPSources         httpSourceFlag
+	SaveToken           bool
+	MetricsAddr         string
+	AuditLog            string
+	HealthAddr          string
+	Mlock               bool
+	DisableCoreDumps    bool
+	Require             *requireFlag
+	SkipCapabilityCheck bool
+	SkipCIMask          bool
+	ValueRules          *valueRuleFlag
+	StatsdAddr          string
+	StatsdPrefix        string
+	StatsdTags          *statsdTagFlag
+	Notify              vaultexec.Notifier
+	Nomad               vaultexec.NomadOptions
+}
+
+// headerFlag is a repeatable command line option of "Name: value" headers.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var headers []string
+	for name, values := range h {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h headerFlag) repeatable() {}
+
+func (h headerFlag) Set(header string) error {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+		return fmt.Errorf("invalid header %q, must be in the form \"Name: value\"", header)
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// sourcePluginFlag is a repeatable command line option of "name=command"
+// secret source plugins.
+type sourcePluginFlag map[string]string
+
+func (p sourcePluginFlag) String() string {
+	var plugins []string
+	for name, command := range p {
+		plugins = append(plugins, name+"="+command)
+	}
+	return strings.Join(plugins, ", ")
+}
+
+func (p sourcePluginFlag) repeatable() {}
+
+func (p sourcePluginFlag) Set(plugin string) error {
+	parts := strings.SplitN(plugin, "=", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+		return fmt.Errorf("invalid secret source plugin %q, must be in the form \"name=command\"", plugin)
+	}
+	p[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
+
+// httpSourceFlag is a repeatable command line option of "name=URL options"
+// HTTP JSON secret sources.
+type httpSourceFlag map[string]string
+
+func (h httpSourceFlag) String() string {
+	var sources []string
+	for name, spec := range h {
+		sources = append(sources, name+"="+spec)
+	}
+	return strings.Join(sources, ", ")
+}
+
+func (h httpSourceFlag) repeatable() {}
+
+func (h httpSourceFlag) Set(source string) error {
+	parts := strings.SplitN(source, "=", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+		return fmt.Errorf("invalid HTTP secret source %q, must be in the form \"name=URL\"", source)
+	}
+	h[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
+
+// requireFlag is a repeatable command line option of comma separated keys that
+// must be in the secrets, optionally prefixed with "path#" to require them
+// from a specific path.
+type requireFlag []vaultexec.RequiredKey
+
+func (r *requireFlag) String() string {
+	if r == nil {
+		return ""
+	}
+	var keys []string
+	for _, key := range *r {
+		keys = append(keys, key.String())
+	}
+	return strings.Join(keys, ", ")
+}
+
+func (r *requireFlag) repeatable() {}
+
+func (r *requireFlag) Set(keys string) error {
+	required, err := vaultexec.ParseRequiredKeys(keys)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, required...)
+	return nil
+}
+
+// valueRuleFlag is a repeatable command line option of "KEY=rule" rules that
+// secret values must match.
+type valueRuleFlag []vaultexec.ValueRule
+
+func (v *valueRuleFlag) String() string {
+	if v == nil {
+		return ""
+	}
+	var rules []string
+	for _, rule := range *v {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (v *valueRuleFlag) repeatable() {}
+
+func (v *valueRuleFlag) Set(s string) error {
+	rule, err := vaultexec.ParseValueRule(s)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	*v = append(*v, rule)
+	return nil
+}
+
+// statsdTagFlag is a repeatable command line option of "name:value" tags.
+type statsdTagFlag []string
+
+func (t *statsdTagFlag) String() string {
+	if t == nil {
+		return ""
 	}
+	return strings.Join(*t, ", ")
+}
+
+func (t *statsdTagFlag) repeatable() {}
+
+func (t *statsdTagFlag) Set(tag string) error {
+	tag = strings.TrimSpace(tag)
+	if len(tag) == 0 || strings.ContainsAny(tag, ",|#") {
+		return fmt.Errorf("invalid statsd tag %q, must be in the form \"name:value\" or \"name\"", tag)
+	}
+	*t = append(*t, tag)
+	return nil
 }
 
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "vaultexec - Run commands with secrets from Vault.\n")
-		fmt.Fprintf(os.Stderr, "Usage: vaultexec [options] command arg1 arg2 arg3\n")
+		fmt.Fprintf(os.Stderr, "Usage: vaultexec [exec] [options] command arg1 arg2 arg3\n")
+		fmt.Fprintf(os.Stderr, "       vaultexec fetch [options]     Print the secrets, see -format\n")
+		fmt.Fprintf(os.Stderr, "       vaultexec renew [options]     Renew the token once\n")
+		fmt.Fprintf(os.Stderr, "       vaultexec validate [options]  Check the configuration, token, and paths\n")
+		fmt.Fprintf(os.Stderr, "       vaultexec version             Print the version\n")
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "Providing any command line option will override the equivalent environment variable.\n")
+		fmt.Fprintf(os.Stderr, "Every option can also be set with a VAULTEXEC_ environment variable, e.g. VAULTEXEC_LOG_LEVEL for -log-level.\n")
+		fmt.Fprintf(os.Stderr, "Options are taken from the command line, then VAULTEXEC_ environment variables, then VAULT_ environment variables, then the config file.\n")
 		fmt.Fprintf(os.Stderr, "Note that with multiple paths separated by a delimiter, the fetched values will overwrite previously received values.\n")
 	}
 
 	// First read command line options.
-	address := flag.String("address", "", "https://path.to.vault:8200 - Can also be set with the ENV VAULT_ADDR")
-	token := flag.String("token", "", "xxxxxxxx-yyyy-yyyy-yyyy-xxxxxxxxxxxx - Can also be set with the ENV VAULT_TOKEN")
-	path := flag.String("path", "", "path/to/secrets/location - Can also be set with the ENV VAULT_PATH")
-	pathDelim := flag.String("path-delim", ",", "Delimeter separating multiple paths. Defaults to a comma (,) - can also be set with ENV VAULT_PATH_DELIM")
-	generateConfig := flag.String(
+	var options Options
+	flag.StringVar(&options.ConfigFile, "config", "", "Path to a YAML or JSON config file declaring any of these options. Options on the command line or in the environment take precedence. Defaults to the closest .vaultexec file in the working directory or its parents.")
+	flag.StringVar(&options.Profile, "profile", "", "Name of a profile in the config file whose options should be used, e.g. staging")
+	var flagConfig vaultexec.VaultConfig
+	flag.StringVar(&flagConfig.Address, "address", "", "https://path.to.vault:8200 - Comma separate multiple addresses to fail over between them - Can also be set with the ENV VAULT_ADDR")
+	flag.StringVar(&flagConfig.Token, "token", "", "xxxxxxxx-yyyy-yyyy-yyyy-xxxxxxxxxxxx - Can also be set with the ENV VAULT_TOKEN")
+	flag.StringVar(&flagConfig.Path, "path", "", "path/to/secrets/location - Can also be set with the ENV VAULT_PATH")
+	flag.StringVar(&flagConfig.PathDelim, "path-delim", ",", "Delimeter separating multiple paths. Defaults to a comma (,) - can also be set with ENV VAULT_PATH_DELIM")
+	flag.StringVar(&flagConfig.CACert, "ca-cert", "", "Path to a PEM encoded CA certificate to verify the vault server with - Can also be set with the ENV VAULT_CACERT")
+	flag.StringVar(&flagConfig.CAPath, "ca-path", "", "Path to a directory of PEM encoded CA certificates - Can also be set with the ENV VAULT_CAPATH")
+	flag.StringVar(&flagConfig.ClientCert, "client-cert", "", "Path to a PEM encoded client certificate for TLS authentication - Can also be set with the ENV VAULT_CLIENT_CERT")
+	flag.StringVar(&flagConfig.ClientKey, "client-key", "", "Path to the private key for the client certificate - Can also be set with the ENV VAULT_CLIENT_KEY")
+	flag.BoolVar(&flagConfig.TLSSkipVerify, "tls-skip-verify", false, "Do not verify the vault server's TLS certificate (insecure) - Can also be set with the ENV VAULT_SKIP_VERIFY")
+	flag.StringVar(&flagConfig.TLSServerName, "tls-server-name", "", "Name to use as the SNI host when connecting via TLS - Can also be set with the ENV VAULT_TLS_SERVER_NAME")
+	flag.StringVar(&flagConfig.Proxy, "proxy", "", "http://proxy.host:3128 - Proxy for requests to vault, overrides HTTP_PROXY/HTTPS_PROXY - Can also be set with the ENV VAULT_HTTP_PROXY")
+	flagConfig.Headers = http.Header{}
+	flag.Var(headerFlag(flagConfig.Headers), "header", "\"X-Custom: value\" - A header to send with every request to vault, can be repeated")
+	flag.DurationVar(&flagConfig.RequestTimeout, "request-timeout", vaultexec.DefaultRequestTimeout, "Timeout for each request to vault, 0 to disable - Can also be set with the ENV VAULT_CLIENT_TIMEOUT")
+	flag.DurationVar(&flagConfig.DialTimeout, "dial-timeout", vaultexec.DefaultDialTimeout, "Timeout for establishing a connection (including the TLS handshake) to vault, 0 to disable")
+	flag.IntVar(&flagConfig.MaxRetries, "max-retries", vaultexec.DefaultMaxRetries, "Number of times to retry requests that fail with a transient error - Can also be set with the ENV VAULT_MAX_RETRIES")
+	flag.DurationVar(&flagConfig.RetryWaitMin, "retry-wait-min", vaultexec.DefaultRetryWaitMin, "Minimum time to wait before retrying a request")
+	flag.DurationVar(&flagConfig.RetryWaitMax, "retry-wait-max", vaultexec.DefaultRetryWaitMax, "Maximum time to wait before retrying a request")
+	flag.DurationVar(&flagConfig.UnavailableTimeout, "retry-unavailable", 0, "How long to keep retrying requests while vault is sealed or has no active node (HTTP 503), e.g. 10m, to ride out maintenance. Defaults to only retrying -max-retries times.")
+	flag.IntVar(&flagConfig.FetchConcurrency, "fetch-concurrency", vaultexec.DefaultFetchConcurrency, "Number of paths to fetch at once, 1 to fetch them one at a time. Secrets from later paths still override earlier ones.")
+	flag.DurationVar(&flagConfig.ControlGroupTimeout, "control-group-timeout", 0, "How long to wait for reads that need control group approval to be authorized, e.g. 30m (Vault Enterprise). Defaults to failing right away.")
+	flag.BoolVar(&flagConfig.KeyNaming.PathPrefix, "envconsul", false, "Name the keys from vault like envconsul does, prefixed by their path with any / replaced by _ (e.g. secret_my-app_password), for applications migrating from envconsul")
+	flag.BoolVar(&flagConfig.KeyNaming.Sanitize, "sanitize", false, "Replace any character in a key that isn't a letter, number, or underscore with _, like envconsul's -sanitize")
+	flag.BoolVar(&flagConfig.KeyNaming.Upcase, "upcase", false, "Convert the keys to upper case, like envconsul's -upcase")
+	flag.StringVar(&flagConfig.AllowedHosts, "allow-vault-host", "", "vault.other:8200 - Other vault servers that vault://host/path references can read from with the token, comma separated. Can't be set by a project config file that wasn't given with -config.")
+	flag.Float64Var(&flagConfig.RateLimit, "rate-limit", 0, "Maximum requests per second to send to vault, 0 for no limit - Can also be set with the ENV VAULT_RATE_LIMIT as rate:burst")
+	flag.IntVar(&flagConfig.RateLimitBurst, "rate-limit-burst", 0, "Number of requests that can be sent to vault at once before the rate limit applies. Defaults to the rate limit.")
+	flag.BoolVar(&flagConfig.RequireConsistency, "require-consistency", false, "Send the X-Vault-Index state from previous responses with every request, so reads from performance standbys see prior writes (Vault Enterprise)")
+	flag.StringVar(&flagConfig.VaultIndex, "vault-index", "", "An X-Vault-Index state (e.g. from the write that stored the secrets) that reads must be consistent with - Can also be set with the ENV VAULT_INDEX")
+	flag.StringVar(&flagConfig.InconsistentRead, "inconsistent-read", "", "What a standby should do with a read it can't serve consistently: forward-active-node or fail (the default, which is retried)")
+	flag.StringVar(
+		&options.GenerateConfig.Command,
 		"generate-config",
 		"",
 		`A command to run to generate the vault config.
 		Will be passed all environment variables that were passed to VaultExec, along with any of the
 		flags that were passed to vaultexec (as environment variables).
-		Must output a JSON formatted object with an address, token, and path key to stdout.`)
+		Must output a JSON formatted object with an address, token, and path key to stdout.
+		May include arguments, e.g. "fetch-token --env prod".`)
+	flag.BoolVar(&options.GenerateConfig.Shell, "generate-config-shell", false, "Run the generate-config command with the system shell (sh -c) rather than splitting it into arguments.")
+	flag.StringVar(&options.GenerateConfig.CacheFile, "generate-config-cache", "", "File to cache the output of the generate-config command in, so that it isn't run again until the cache expires.")
+	flag.DurationVar(&options.GenerateConfig.CacheTTL, "generate-config-ttl", vaultexec.DefaultGenerateConfigTTL, "How long cached generate-config output is used for.")
+	flag.DurationVar(&options.StartupTimeout, "startup-timeout", 0, "How long exec can take to connect to vault (including generate-config and -wait-for-vault) and fetch the secrets before -startup-timeout-policy applies, e.g. 30s. Defaults to no limit.")
+	flag.StringVar(&options.StartupPolicy, "startup-timeout-policy", startupPolicyFail, "What to do when -startup-timeout passes: fail, cache (run the command with the secrets from -secret-cache, within -allow-stale), or empty (run the command without secrets)")
+	flag.StringVar(&options.SecretCache.File, "secret-cache", "", "File to cache the secrets in, encrypted with -secret-cache-key, whenever they are fetched, for use with -allow-stale.")
+	flag.StringVar(&options.SecretCache.KeyFile, "secret-cache-key", "", "File containing a hex encoded 256 bit key (e.g. from openssl rand -hex 32) to encrypt the secret cache with.")
+	flag.DurationVar(&options.SecretCache.AllowStale, "allow-stale", 0, "How old cached secrets can be (e.g. 1h) and still be used when vault is unreachable. Defaults to never using them.")
+	flag.DurationVar(&options.WaitForVault, "wait-for-vault", 0, "How long to wait for vault to be initialized and unsealed before fetching secrets, e.g. 2m. Defaults to not waiting.")
+	flag.BoolVar(&options.WaitForVaultActive, "wait-for-vault-active", false, "When waiting for vault, also wait until the server is the active node rather than a standby.")
+	flag.StringVar(&options.WaitFor, "wait-for", "", "tcp://db:5432,http://api/health - Services to wait for before exec runs the command, until a TCP connection succeeds or an HTTP(S) URL responds with a 2xx status.")
+	flag.DurationVar(&options.WaitTimeout, "wait-timeout", 60*time.Second, "How long to wait for the -wait-for services, 0 to wait forever.")
+	flag.DurationVar(&options.RenewIncrement, "renew-increment", 0, "Lease length to request when renewing the token, e.g. 1h. Defaults to the backend default.")
+	flag.BoolVar(&options.DryRun, "dry-run", false, "Fetch secrets and print the names of the environment variables that would be set (never the values) and which path each came from, without running the command.")
+	flag.BoolVar(&options.RevokeLeasesOnExit, "revoke-leases-on-exit", false, "Revoke the leases of any dynamic secrets once the command exits.")
+	flag.StringVar(&options.LogLevel, "log-level", "info", "Verbosity of vaultexec's own logging: debug, info, warn, or error. Debug traces every request and configuration decision, with tokens and secret values always redacted.")
+	flag.BoolVar(&options.Quiet, "quiet", false, "Suppress vaultexec's own messages (e.g. forwarded signals, retries), only logging errors. Useful when the command's output is parsed by another program.")
+	flag.StringVar(&options.LogFile, "log-file", "", "Write vaultexec's own logs to this file rather than stderr. The file is reopened when vaultexec receives SIGUSR1, for log rotation.")
+	flag.BoolVar(&options.LogSyslog, "log-syslog", false, "Write vaultexec's own logs to syslog (or journald) rather than stderr.")
+	flag.BoolVar(&options.Nomad.Enabled, "nomad", false, "When no token is given, log in to vault with the Nomad task's workload identity (from NOMAD_TOKEN_vault_default, NOMAD_TOKEN, or the task's secrets directory) through the JWT auth method.")
+	flag.StringVar(&options.Nomad.AuthMount, "nomad-auth-mount", vaultexec.DefaultNomadAuthMount, "Path the JWT auth method for Nomad workload identities is mounted at.")
+	flag.StringVar(&options.Nomad.Role, "nomad-role", "", "Role to log in with the Nomad workload identity as. Defaults to the auth method's default role.")
+	flag.BoolVar(&options.SaveToken, "save-token", false, "Save a token entered at the prompt (when no token is given and vaultexec is run in a terminal) to ~/.vault-token, which is used when no token is given.")
+	flag.StringVar(&options.MetricsAddr, "metrics-addr", "", "Address (e.g. :9090) to serve Prometheus metrics at /metrics on while the command runs: fetch latency, token renewals and TTL, and command uptime.")
+	flag.StringVar(&options.StatsdAddr, "statsd-addr", "", "Address (e.g. 127.0.0.1:8125) of a statsd server to send fetch counts and latency, token renewals and TTL, and the command's exit code to.")
+	flag.StringVar(&options.StatsdPrefix, "statsd-prefix", "vaultexec.", "Prefix for the names of the metrics sent to statsd.")
+	options.StatsdTags = &statsdTagFlag{}
+	flag.Var(options.StatsdTags, "statsd-tag", "\"name:value\" - A DogStatsD tag to send with every metric, can be repeated")
+	flag.StringVar(&options.AuditLog, "audit-log", "", "File to append a JSON lines audit record of the paths read, the keys read from each, and the environment variables they were injected as (never values) to, or - for stderr.")
+	flag.StringVar(&options.HealthAddr, "health-addr", "", "Address (e.g. :8080) to serve a health check at /health on while the command runs, for liveness and readiness probes. Responds with 503 unless the command is running and the token is renewing.")
+	flag.BoolVar(&options.Mlock, "mlock", false, "Lock vaultexec's memory into RAM so that the token and secrets are never swapped to disk (linux only). This requires the IPC_LOCK capability.")
+	flag.BoolVar(&options.DisableCoreDumps, "disable-core-dumps", false, "Stop vaultexec writing a core dump if it crashes and, on linux, stop other processes of the same user attaching to it with ptrace, so that neither can expose the token and secrets.")
+	flag.StringVar(&options.Notify.WebhookURL, "notify-webhook", "", "URL to POST lifecycle events (renewal_failure, child_start, child_exit) to as JSON.")
+	flag.StringVar(&options.Notify.Command, "notify-command", "", "Command to run for every lifecycle event (renewal_failure, child_start, child_exit), with the event as JSON on stdin and its name in VAULTEXEC_EVENT.")
+	options.ValueRules = &valueRuleFlag{}
+	flag.Var(options.ValueRules, "value-rule", "\"KEY=rule\" - A rule that the value of a key must match, failing before the command is run if it doesn't: non-empty, numeric, url, or regex:<pattern>, can be repeated")
+	flag.BoolVar(&options.SkipCapabilityCheck, "skip-capability-check", false, "Don't check that the token can read every path (via sys/capabilities-self) before fetching secrets, for tokens without access to it.")
+	flag.BoolVar(&options.SkipCIMask, "skip-ci-mask", false, "Don't mask the secret values in the job log when running under GitHub Actions (with ::add-mask:: commands on stderr).")
+	options.Require = &requireFlag{}
+	flag.Var(options.Require, "require", "\"KEY1,KEY2\" - Keys that must be in the secrets, failing before the command is run if any are missing. Prefix with \"path#\" to require keys from a specific path, can be repeated")
+	options.SourcePlugins = sourcePluginFlag{}
+	flag.Var(options.SourcePlugins, "source-plugin", "\"name=command\" - A plugin command that secrets can be read from with paths like name://path/to/secrets, can be repeated")
+	options.HTTPSources = httpSourceFlag{}
+	flag.Var(options.HTTPSources, "http-source", "\"name=URL [header=...] [jsonpath=...]\" - An HTTP JSON API (e.g. 1Password Connect) that secrets can be read from with paths like name://path, which replaces {path} in the URL, can be repeated")
+	flag.StringVar(&options.Format, "format", "env", "Output format for the fetch subcommand: env (KEY=value lines that can be sourced by a shell), json, exec-credential (a Kubernetes ExecCredential, for use as a kubectl credential plugin), or terraform (the protocol of Terraform's external data source, whose query can set the path)")
+	flag.StringVar(&options.ExecCredentialKey, "exec-credential-key", "token", "Key of the secret holding the cluster token for -format exec-credential")
+
+	// The subcommand comes first, and defaults to exec so that the bare
+	// "vaultexec [options] command" form keeps working.  To exec a command that
+	// shares its name with a subcommand use "vaultexec exec command".
+	subcommand := subcommands[0]
+	args := os.Args[1:]
+	if len(args) > 0 {
+		for _, name := range subcommands {
+			if args[0] == name {
+				subcommand = name
+				args = args[1:]
+				break
+			}
+		}
+	}
+
+	if subcommand == "version" {
+		fmt.Printf("vaultexec %s\n", Version)
+		return
+	}
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
+
+	// Where each option was set, for error messages.
+	optionSources := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		optionSources[f.Name] = "the command line"
+	})
+
+	errCheck(ApplyEnvOptions(flag.CommandLine), ExitConfigError)
+	errCheck(setLogLevel(options), ExitConfigError)
+
+	flag.Visit(func(f *flag.Flag) {
+		if _, ok := optionSources[f.Name]; ok {
+			vaultexec.LogDebugf("Using option %s from the command line", f.Name)
+		} else {
+			optionSources[f.Name] = optionEnvVar(f.Name)
+			vaultexec.LogDebugf("Using option %s from the environment (%s)", f.Name, optionSources[f.Name])
+		}
+	})
+
+	fileSources, err := applyConfigFileOptions(options)
+	errCheck(err, ExitConfigError)
+	for name, source := range fileSources {
+		optionSources[name] = source
+	}
+
+	errCheck(CheckOptionCombinations(flag.CommandLine, optionSources), ExitConfigError)
+
+	// The log level may have been set by the config file.
+	errCheck(setLogLevel(options), ExitConfigError)
+	errCheck(setLogDestination(options), ExitConfigError)
 
 	cmd := flag.Args()
 
-	if len(cmd) == 0 {
-		errCheck(errors.New("Must provide a command"))
+	if subcommand == "exec" && len(cmd) == 0 && !options.DryRun {
+		errCheck(errors.New("Must provide a command"), ExitConfigError)
+	}
+
+	if subcommand != "exec" && len(cmd) > 0 {
+		errCheck(fmt.Errorf("unexpected arguments for %s: %s", subcommand, strings.Join(cmd, " ")), ExitConfigError)
+	}
+
+	// Vault takes the increment in whole seconds, so a shorter one would
+	// request the backend default instead.
+	if options.RenewIncrement > 0 && options.RenewIncrement < time.Second {
+		errCheck(fmt.Errorf("invalid renew increment %s, must be at least 1s", options.RenewIncrement), ExitConfigError)
+	}
+
+	if len(options.StatsdAddr) > 0 {
+		errCheck(vaultexec.SetStatsd(options.StatsdAddr, options.StatsdPrefix, *options.StatsdTags), ExitConfigError)
+	}
+
+	if len(options.Notify.WebhookURL) > 0 || len(options.Notify.Command) > 0 {
+		vaultexec.SetNotifier(&options.Notify)
+	}
+
+	// Lock memory and disable core dumps before the token and secrets are
+	// fetched.
+	if options.Mlock {
+		errCheck(vaultexec.LockMemory(), ExitConfigError)
+	}
+	if options.DisableCoreDumps {
+		errCheck(vaultexec.DisableCoreDumps(), ExitConfigError)
+	}
+
+	errCheck(registerSourcePlugins(options.SourcePlugins), ExitConfigError)
+	errCheck(registerHTTPSources(options.HTTPSources), ExitConfigError)
+
+	// Renewing the token is the only subcommand that doesn't read secrets.
+	requirePath := subcommand != "renew"
+
+	// Exec connects to vault itself, within the startup deadline.
+	if subcommand == "exec" {
+		runExec(flagConfig, options, cmd)
+		return
+	}
+
+	// Terraform sends the query on stdin before anything is fetched.
+	if subcommand == "fetch" && options.Format == "terraform" {
+		errCheck(applyTerraformQuery(os.Stdin, &flagConfig), ExitConfigError)
+	}
+
+	config, err := connectToVault(flagConfig, options, cmd, requirePath)
+	errCheck(err, ExitConfigError)
+
+	switch subcommand {
+	case "fetch":
+		runFetch(config, options)
+	case "renew":
+		runRenew(config, options)
+	case "validate":
+		runValidate(config)
+	}
+}
+
+// setLogLevel sets the log level from the options, with -quiet taking
+// precedence over -log-level.
+func setLogLevel(options Options) error {
+	if options.Quiet {
+		return vaultexec.SetLogLevel("error")
+	}
+	return vaultexec.SetLogLevel(options.LogLevel)
+}
+
+// setLogDestination sends vaultexec's own logs to a file or syslog, if
+// requested.  The command's stdout and stderr are never affected.
+func setLogDestination(options Options) error {
+	if len(options.LogFile) > 0 {
+		return vaultexec.SetLogFile(options.LogFile)
+	}
+
+	if options.LogSyslog {
+		return vaultexec.SetLogSyslog()
+	}
+
+	return nil
+}
+
+// registerSourcePlugins registers every secret source plugin, so that paths
+// can be read from them.
+func registerSourcePlugins(plugins sourcePluginFlag) error {
+	for name, command := range plugins {
+		source, err := vaultexec.NewExecSecretSource(command)
+		if err != nil {
+			return err
+		}
+
+		err = vaultexec.RegisterSecretSource(name, source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerHTTPSources registers every HTTP JSON secret source, so that paths
+// can be read from them.
+func registerHTTPSources(sources httpSourceFlag) error {
+	for name, spec := range sources {
+		source, err := vaultexec.NewHTTPSecretSource(spec)
+		if err != nil {
+			return err
+		}
+
+		err = vaultexec.RegisterSecretSource(name, source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vaultTokenFromUser returns the token saved in ~/.vault-token, or otherwise
+// prompts for one if vaultexec is being run in a terminal without a startup
+// deadline.
+func vaultTokenFromUser(options Options) (string, error) {
+	token, err := vaultexec.ReadVaultTokenFile()
+	if err != nil {
+		return "", err
+	}
+
+	if len(token) > 0 {
+		vaultexec.LogDebugf("Using the token from ~/.vault-token")
+		return token, nil
+	}
+
+	// With a startup deadline, the prompt could still be waiting once the
+	// command has been started without the secrets.
+	if options.StartupTimeout > 0 {
+		return "", nil
+	}
+
+	token, err = vaultexec.PromptForVaultToken()
+	if err != nil || len(token) == 0 {
+		return token, err
+	}
+
+	if options.SaveToken {
+		err = vaultexec.SaveVaultTokenFile(token)
+	}
+
+	return token, err
+}
+
+// applyConfigFileOptions applies the options from the config file (or the
+// project's config file, if one wasn't given) for any options that weren't
+// already provided, returning where each option it set was declared.
+func applyConfigFileOptions(options Options) (map[string]string, error) {
+	// Without an explicit config file, look for one belonging to the project
+	// we're being run in.
+	discovered := len(options.ConfigFile) == 0
+	if discovered {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		options.ConfigFile, err = FindProjectConfigFile(wd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(options.ConfigFile) == 0 {
+		if len(options.Profile) > 0 {
+			return nil, fmt.Errorf("profile %s requires a config file", options.Profile)
+		}
+		return nil, nil
 	}
 
-	config, err := NewVaultConfig(address, token, path, pathDelim)
-	errCheck(err)
+	file, err := LoadConfigFile(options.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ValidateConfigFile(flag.CommandLine, file)
+	if err != nil {
+		return nil, err
+	}
 
-	if len(*generateConfig) > 0 {
-		config, err = GenerateVaultConfig(generateConfig, config)
-		errCheck(err)
+	fileOptions, err := SelectConfigProfile(file, options.Profile)
+	if err != nil {
+		return nil, err
 	}
 
-	errCheck(ValidateVaultConfig(config))
+	// A project config file is only trusted with options that can't run
+	// commands or send the token elsewhere.
+	if discovered {
+		for _, name := range projectConfigDeniedOptions {
+			if option, ok := fileOptions[name]; ok {
+				return nil, fmt.Errorf("%s: option %s can only be set in a config file given with -config", file.location(option.key), name)
+			}
+		}
+	}
 
-	vaultSecrets, err := GetVaultSecrets(config)
-	errCheck(err)
+	return ApplyConfigFile(flag.CommandLine, file, fileOptions)
+}
 
-	// Renew the token periodically (half of every lease duration), starting
-	// right now.
-	go func() {
-		renewable, err := GetVaultTokenRenewable(config)
+// loadVaultConfig builds the complete, validated VaultConfig from the command
+// line options, environment, and generate-config command, falling back to the
+// token saved in ~/.vault-token or prompting for one.  The secret path is only
+// validated if requirePath is set.
+func loadVaultConfig(flagConfig vaultexec.VaultConfig, options Options, cmd []string, requirePath bool) (vaultexec.VaultConfig, error) {
+	config, err := vaultexec.NewVaultConfig(flagConfig)
+	if err != nil {
+		return config, err
+	}
 
+	if len(options.GenerateConfig.Command) > 0 {
+		config, err = vaultexec.GenerateVaultConfig(options.GenerateConfig, cmd, config)
 		if err != nil {
-			log.Printf("error determining renewable token: %s", err)
-			return
+			return config, err
 		}
+	}
 
-		if !renewable {
-			return
+	if len(config.Token) == 0 && options.Nomad.Enabled {
+		jwt, err := vaultexec.NomadWorkloadIdentity()
+		if err != nil {
+			return config, err
 		}
 
-		leaseTimeout := 0 * time.Second
-		for {
-			time.Sleep(leaseTimeout * time.Second)
-			leaseDuration, err := RenewVaultToken(config)
-			if err != nil {
-				log.Printf("error renewing vault token: %s", err)
-				// If there was an error renewing the token, it should stop trying to
-				// renew (otherwise it will repeatedly try to renew with no delay)
-				return
+		config.Token, err = vaultexec.LoginWithJWT(config, options.Nomad.AuthMount, options.Nomad.Role, jwt)
+		if err != nil {
+			code := ExitFetchError
+			if _, ok := err.(*vaultexec.VaultAuthError); ok {
+				code = ExitAuthError
 			}
-			leaseTimeout = time.Duration(leaseDuration) / 2
+			return config, &exitError{fmt.Errorf("error logging in with the Nomad workload identity: %s", err), code}
+		}
+	}
+
+	if len(config.Token) == 0 {
+		config.Token, err = vaultTokenFromUser(options)
+		if err != nil {
+			return config, err
 		}
-	}()
+	}
+
+	if requirePath {
+		err = vaultexec.ValidateVaultConfig(config)
+	} else {
+		err = vaultexec.ValidateVaultConnectionConfig(config)
+	}
+	if err != nil {
+		return config, err
+	}
 
-	// This is a blocking call that runs several go-funcs to manage sending
-	// signals to the process.
-	errCheck(RunWithEnvVars(cmd, vaultSecrets))
+	// Every request made from here on shares a single HTTP client.
+	return vaultexec.WithVaultClient(config)
 }
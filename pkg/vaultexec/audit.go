@@ -0,0 +1,80 @@
+package vaultexec
+
+// audit.go includes an audit log of which secrets a process consumed: the
+// paths read, the keys read from each, and the environment variables they
+// were injected as.  Secret values are never included.
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// AuditRecord is a single line of the audit log.
+type AuditRecord struct {
+	Time    time.Time    `json:"time"`
+	PID     int          `json:"pid"`   // The process ID of vaultexec
+	Event   string       `json:"event"` // read, inject, or output
+	Path    string       `json:"path,omitempty"`
+	Keys    []string     `json:"keys,omitempty"`
+	Command string       `json:"command,omitempty"`
+	Env     []AuditedEnv `json:"env,omitempty"`
+}
+
+// AuditedEnv is an environment variable that a secret was injected as.
+type AuditedEnv struct {
+	Name string `json:"name"`
+	Key  string `json:"key"` // The key read from the path, before key naming
+	Path string `json:"path"`
+}
+
+// OpenAuditLog opens the audit log at path for appending, or returns stderr if
+// path is "-".
+func OpenAuditLog(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{os.Stderr}, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// WriteAuditLog writes a record of every path read for the secrets, then a
+// record of the environment variables they were given to the command as (the
+// inject event) or printed as (the output event, with no command).  Records
+// are JSON, one per line.
+func WriteAuditLog(w io.Writer, secrets VaultSecrets, event string, command []string) error {
+	encoder := json.NewEncoder(w)
+	now := time.Now().UTC()
+	pid := os.Getpid()
+
+	for _, read := range secrets.Reads {
+		err := encoder.Encode(AuditRecord{Time: now, PID: pid, Event: "read", Path: read.Path, Keys: read.Keys})
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(secrets.Values))
+	for name := range secrets.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	record := AuditRecord{Time: now, PID: pid, Event: event, Command: QuoteCommandLine(command)}
+	for _, name := range names {
+		key, ok := secrets.SourceKeys[name]
+		if !ok {
+			key = name
+		}
+		record.Env = append(record.Env, AuditedEnv{Name: name, Key: key, Path: secrets.Sources[name]})
+	}
+
+	return encoder.Encode(record)
+}
@@ -0,0 +1,288 @@
+package vaultexec
+
+// awscredentials.go includes finding the AWS credentials for awssm://
+// references, in the same order as the AWS SDKs: the standard environment
+// variables, a web identity token (e.g. IRSA on EKS), the container
+// credentials endpoint (ECS task roles), and the EC2 instance metadata
+// service (instance profiles, with IMDSv2).
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The endpoints that ECS and EC2 serve credentials from.
+const (
+	awsContainerCredentialsHost = "http://169.254.170.2"
+	awsInstanceMetadataAddress  = "http://169.254.169.254"
+)
+
+// How long a request for credentials can take.  The instance metadata service
+// is only tried when nothing else is configured, so it must fail quickly off
+// EC2.
+const awsCredentialsRequestTimeout = 5 * time.Second
+
+// Temporary credentials are refreshed this long before they expire.
+const awsCredentialsExpiryWindow = 5 * time.Minute
+
+// awsCredentials are the credentials requests are signed with.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time // Zero for credentials that don't expire
+}
+
+// The temporary credentials last fetched from an endpoint, reused until they
+// are about to expire.
+var (
+	cachedAWSCredentials      awsCredentials
+	cachedAWSCredentialsMutex sync.Mutex
+)
+
+// getAWSCredentials returns the credentials to sign requests in region with.
+func getAWSCredentials(region string) (awsCredentials, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if len(accessKey) > 0 && len(secretKey) > 0 {
+		return awsCredentials{
+			AccessKeyID:     accessKey,
+			SecretAccessKey: secretKey,
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	cachedAWSCredentialsMutex.Lock()
+	defer cachedAWSCredentialsMutex.Unlock()
+
+	if len(cachedAWSCredentials.AccessKeyID) > 0 &&
+		time.Now().Add(awsCredentialsExpiryWindow).Before(cachedAWSCredentials.Expiration) {
+		return cachedAWSCredentials, nil
+	}
+
+	var credentials awsCredentials
+	var err error
+	switch {
+	case len(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")) > 0:
+		credentials, err = getAWSWebIdentityCredentials(region)
+	case len(os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")) > 0 || len(os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")) > 0:
+		credentials, err = getAWSContainerCredentials()
+	case strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true"):
+		err = errors.New("no AWS credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or use a web identity, container, or instance role")
+	default:
+		credentials, err = getAWSInstanceCredentials()
+		if err != nil {
+			err = fmt.Errorf("no AWS credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or use a web identity, container, or instance role (the instance metadata service failed: %s)", err)
+		}
+	}
+	if err != nil {
+		return credentials, err
+	}
+
+	RedactToken(credentials.SecretAccessKey)
+	RedactToken(credentials.SessionToken)
+	cachedAWSCredentials = credentials
+
+	return credentials, nil
+}
+
+// awsEndpointCredentials is the response from the container credentials
+// endpoint and the instance metadata service.
+type awsEndpointCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (c awsEndpointCredentials) credentials(source string) (awsCredentials, error) {
+	if len(c.AccessKeyID) == 0 || len(c.SecretAccessKey) == 0 {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials in the response from %s", source)
+	}
+	return awsCredentials{c.AccessKeyID, c.SecretAccessKey, c.Token, c.Expiration}, nil
+}
+
+// getAWSContainerCredentials returns the credentials of an ECS task role (or
+// anything else serving the container credentials endpoint).
+func getAWSContainerCredentials() (awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); len(relative) > 0 {
+		endpoint = awsContainerCredentialsHost + relative
+	}
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	authorization := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); len(file) > 0 {
+		tokenBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("error reading the container authorization token: %s", err)
+		}
+		authorization = strings.TrimSpace(string(tokenBytes))
+	}
+	if len(authorization) > 0 {
+		RedactToken(authorization)
+		req.Header.Set("Authorization", authorization)
+	}
+
+	bodyBytes, err := doAWSCredentialsRequest(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error getting AWS container credentials: %s", err)
+	}
+	defer zeroBytes(bodyBytes)
+
+	var response awsEndpointCredentials
+	err = json.Unmarshal(bodyBytes, &response)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid AWS container credentials: %s", err)
+	}
+
+	return response.credentials("the container credentials endpoint")
+}
+
+// getAWSInstanceCredentials returns the credentials of the EC2 instance
+// profile, using an IMDSv2 session token.
+func getAWSInstanceCredentials() (awsCredentials, error) {
+	req, err := http.NewRequest("PUT", awsInstanceMetadataAddress+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+
+	tokenBytes, err := doAWSCredentialsRequest(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := string(tokenBytes)
+	RedactToken(token)
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest("GET", awsInstanceMetadataAddress+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		return doAWSCredentialsRequest(req)
+	}
+
+	roleBytes, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roleBytes), "\n", 2)[0])
+	if len(role) == 0 {
+		return awsCredentials{}, errors.New("the instance has no instance profile")
+	}
+
+	bodyBytes, err := get("/latest/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer zeroBytes(bodyBytes)
+
+	var response awsEndpointCredentials
+	err = json.Unmarshal(bodyBytes, &response)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid instance credentials: %s", err)
+	}
+
+	return response.credentials("the instance metadata service")
+}
+
+// getAWSWebIdentityCredentials exchanges the web identity token in
+// AWS_WEB_IDENTITY_TOKEN_FILE (e.g. a Kubernetes service account token with
+// IRSA) for credentials for AWS_ROLE_ARN, with STS AssumeRoleWithWebIdentity.
+// That request isn't signed, since the token authenticates it.
+func getAWSWebIdentityCredentials(region string) (awsCredentials, error) {
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+	if len(roleARN) == 0 {
+		return awsCredentials{}, errors.New("AWS_WEB_IDENTITY_TOKEN_FILE requires AWS_ROLE_ARN")
+	}
+
+	tokenBytes, err := ioutil.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error reading the AWS web identity token: %s", err)
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+	RedactToken(token)
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if len(sessionName) == 0 {
+		sessionName = fmt.Sprintf("vaultexec-%d", time.Now().Unix())
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_STS")
+	if len(endpoint) == 0 {
+		endpoint = "https://sts." + region + ".amazonaws.com"
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {token},
+	}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	bodyBytes, err := doAWSCredentialsRequest(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("error assuming %s with the web identity token: %s", roleARN, err)
+	}
+	defer zeroBytes(bodyBytes)
+
+	var response struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	err = xml.Unmarshal(bodyBytes, &response)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid response assuming %s with the web identity token: %s", roleARN, err)
+	}
+
+	c := response.Credentials
+	return awsEndpointCredentials{c.AccessKeyID, c.SecretAccessKey, c.SessionToken, c.Expiration}.credentials("STS")
+}
+
+// doAWSCredentialsRequest makes a request for credentials, returning the body
+// of a successful response.
+func doAWSCredentialsRequest(req *http.Request) ([]byte, error) {
+	client := &http.Client{Timeout: awsCredentialsRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		zeroBytes(bodyBytes)
+		return nil, fmt.Errorf("HTTP status %d from %s", resp.StatusCode, req.URL.Host)
+	}
+
+	return bodyBytes, nil
+}
@@ -0,0 +1,236 @@
+package vaultexec
+
+// awssource.go includes the built in source for AWS Secrets Manager, e.g.
+// awssm://my-app/db or awssm://arn:aws:secretsmanager:...:secret:my-app/db, so
+// that secrets can be merged from both vault and Secrets Manager (e.g. while
+// migrating between them).  Credentials are found like the AWS SDKs do (see
+// awscredentials.go), and requests are signed with Signature Version 4.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const awsSecretsManagerService = "secretsmanager"
+
+// How long a request to Secrets Manager can take.
+const awsRequestTimeout = 30 * time.Second
+
+// awsSecretsManagerSource reads secrets from AWS Secrets Manager.  A secret
+// that isn't a JSON object is used as the single value of key.
+type awsSecretsManagerSource struct {
+	key string
+}
+
+// awsSecretValue is the part of a GetSecretValue response that's used.
+type awsSecretValue struct {
+	SecretString *string `json:"SecretString"`
+	SecretBinary []byte  `json:"SecretBinary"` // base64 encoded
+	VersionID    string  `json:"VersionId"`
+}
+
+func (s *awsSecretsManagerSource) Fetch(secretID string) (map[string]interface{}, string, error) {
+	value, err := getAWSSecretValue(secretID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var valueBytes []byte
+	if value.SecretString != nil {
+		valueBytes = []byte(*value.SecretString)
+	} else {
+		valueBytes = value.SecretBinary
+	}
+	defer zeroBytes(valueBytes)
+
+	if secrets := parseSecretsValue(valueBytes); secrets != nil {
+		return secrets, "", nil
+	}
+
+	if len(s.key) == 0 {
+		return nil, "", fmt.Errorf("%s isn't a JSON object, so must be referenced with a #key to use as its name", secretID)
+	}
+
+	return map[string]interface{}{s.key: string(valueBytes)}, "", nil
+}
+
+func (s *awsSecretsManagerSource) Renew(increment time.Duration) (time.Duration, error) {
+	return 0, nil
+}
+
+// Watch polls the secret's version every DefaultWatchInterval.
+func (s *awsSecretsManagerSource) Watch(secretID string, stop <-chan struct{}) error {
+	initial, err := getAWSSecretValue(secretID)
+	if err != nil {
+		return err
+	}
+
+	return pollUntilChanged(stop, func() (bool, error) {
+		current, err := getAWSSecretValue(secretID)
+		return current.VersionID != initial.VersionID, err
+	})
+}
+
+// awsRegion returns the region of a secret, which is part of its ARN, or
+// otherwise taken from the environment.
+func awsRegion(secretID string) (string, error) {
+	if parts := strings.Split(secretID, ":"); len(parts) > 3 && parts[0] == "arn" {
+		return parts[3], nil
+	}
+
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); len(region) > 0 {
+			return region, nil
+		}
+	}
+
+	return "", errors.New("no AWS region, set AWS_REGION or reference the secret by its ARN")
+}
+
+// awsSecretsManagerEndpoint returns the URL of Secrets Manager in a region,
+// which can be overridden with the standard environment variables (e.g. for a
+// VPC endpoint).
+func awsSecretsManagerEndpoint(region string) string {
+	for _, name := range []string{"AWS_ENDPOINT_URL_SECRETS_MANAGER", "AWS_ENDPOINT_URL"} {
+		if endpoint := os.Getenv(name); len(endpoint) > 0 {
+			return endpoint
+		}
+	}
+
+	return "https://secretsmanager." + region + ".amazonaws.com"
+}
+
+// getAWSSecretValue returns the current value of a secret.
+func getAWSSecretValue(secretID string) (awsSecretValue, error) {
+	var value awsSecretValue
+
+	region, err := awsRegion(secretID)
+	if err != nil {
+		return value, err
+	}
+
+	payload, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return value, err
+	}
+
+	req, err := http.NewRequest("POST", awsSecretsManagerEndpoint(region), bytes.NewReader(payload))
+	if err != nil {
+		return value, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+
+	credentials, err := getAWSCredentials(region)
+	if err != nil {
+		return value, err
+	}
+
+	signAWSRequest(req, payload, region, awsSecretsManagerService, credentials, time.Now())
+
+	client := &http.Client{Timeout: awsRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return value, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return value, err
+	}
+	defer zeroBytes(bodyBytes)
+
+	if resp.StatusCode != http.StatusOK {
+		var awsError struct {
+			Type         string `json:"__type"`
+			Message      string `json:"message"`
+			MessageUpper string `json:"Message"`
+		}
+		json.Unmarshal(bodyBytes, &awsError)
+		if len(awsError.Message) == 0 {
+			awsError.Message = awsError.MessageUpper
+		}
+		return value, fmt.Errorf("AWS Secrets Manager error (HTTP status %d) reading %s: %s %s",
+			resp.StatusCode, secretID, awsError.Type, awsError.Message)
+	}
+
+	err = json.Unmarshal(bodyBytes, &value)
+	return value, err
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header to a request.
+func signAWSRequest(req *http.Request, payload []byte, region string, service string, credentials awsCredentials, now time.Time) {
+	RedactToken(credentials.SecretAccessKey)
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if len(credentials.SessionToken) > 0 {
+		RedactToken(credentials.SessionToken)
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	// Every header set so far is signed, along with the host.
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"", // Requests to Secrets Manager have no query string
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,50 @@
+package vaultexec
+
+// cimask.go includes masking the secrets in the logs of CI systems, so that a
+// command that prints a secret (or a fetch whose output is shown) doesn't leak
+// it into a job log.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// MaskSecretsInCI tells the CI system vaultexec is running under to mask
+// every secret value in its logs.  Under GitHub Actions, an ::add-mask::
+// workflow command is written to w for each line of every value (the runner
+// reads them from stdout and stderr).  GitLab CI can only mask variables
+// defined in its settings, so there it's only logged that the values can't be
+// masked.  Like Redact, values shorter than 4 characters are skipped, since
+// masking them would hide too much of the log.
+func MaskSecretsInCI(w io.Writer, values map[string]interface{}) {
+	if len(values) == 0 {
+		return
+	}
+
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		for _, v := range values {
+			for _, line := range strings.Split(EnvValue(v), "\n") {
+				line = strings.TrimRight(line, "\r")
+				if len(line) >= minRedactedLength {
+					fmt.Fprintf(w, "::add-mask::%s\n", escapeWorkflowCommand(line))
+				}
+			}
+		}
+		LogDebugf("Masked %d secret values in the GitHub Actions log", len(values))
+		return
+	}
+
+	if os.Getenv("GITLAB_CI") == "true" {
+		LogWarnf("GitLab CI can't mask secrets fetched while a job runs, so make sure they aren't printed")
+	}
+}
+
+// escapeWorkflowCommand escapes the characters that can't appear in the value
+// of a GitHub Actions workflow command.
+func escapeWorkflowCommand(s string) string {
+	s = strings.Replace(s, "%", "%25", -1)
+	s = strings.Replace(s, "\r", "%0D", -1)
+	return strings.Replace(s, "\n", "%0A", -1)
+}
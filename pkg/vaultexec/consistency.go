@@ -0,0 +1,46 @@
+package vaultexec
+
+// consistency.go includes support for Vault Enterprise's read-after-write
+// consistency headers.  Performance standbys and replicated clusters may serve
+// reads before they have caught up with recent writes; sending the
+// X-Vault-Index state of those writes makes a standby that is behind answer
+// with 412 Precondition Failed (which is retried), or forward the request to
+// the active node.
+
+import (
+	"net/http"
+)
+
+// Behaviors for reads that would be inconsistent, sent as X-Vault-Inconsistent.
+const (
+	InconsistentForwardActiveNode = "forward-active-node"
+	InconsistentFail              = "fail"
+)
+
+// setConsistencyHeaders adds the consistency headers to a request, if enabled.
+func (client *vaultClient) setConsistencyHeaders(req *http.Request, config VaultConfig) {
+	client.mutex.Lock()
+	vaultIndex := client.vaultIndex
+	client.mutex.Unlock()
+
+	if len(vaultIndex) > 0 && (config.RequireConsistency || len(config.VaultIndex) > 0) {
+		req.Header.Set("X-Vault-Index", vaultIndex)
+	}
+
+	if len(config.InconsistentRead) > 0 {
+		req.Header.Set("X-Vault-Inconsistent", config.InconsistentRead)
+	}
+}
+
+// recordVaultIndex keeps track of the X-Vault-Index state returned by vault,
+// so that subsequent requests see at least the same state.
+func (client *vaultClient) recordVaultIndex(resp *http.Response) {
+	vaultIndex := resp.Header.Get("X-Vault-Index")
+	if len(vaultIndex) == 0 {
+		return
+	}
+
+	client.mutex.Lock()
+	client.vaultIndex = vaultIndex
+	client.mutex.Unlock()
+}
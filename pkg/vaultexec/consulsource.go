@@ -0,0 +1,191 @@
+package vaultexec
+
+// consulsource.go includes the built in source for Consul KV, e.g.
+// consul://config/my-app, so that non-secret configuration can be injected
+// alongside the secrets.  The agent is found with the standard environment
+// variables (CONSUL_HTTP_ADDR, CONSUL_HTTP_SSL, and CONSUL_HTTP_TOKEN).
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The address of the local consul agent, used unless CONSUL_HTTP_ADDR is set.
+const defaultConsulAddress = "127.0.0.1:8500"
+
+// How long a request to consul can take, other than a blocking query.
+const consulRequestTimeout = 30 * time.Second
+
+// How long a blocking query waits for a change before it's repeated.
+const consulWatchWait = 5 * time.Minute
+
+// consulSource reads configuration from Consul KV.  A path is either a key,
+// whose value is used like a file (see fileSource), or a prefix, whose keys
+// are each used as a value, named by the rest of the key with any "/"
+// replaced by "_" (e.g. config/my-app/DB_HOST is DB_HOST for config/my-app).
+type consulSource struct {
+	key string
+}
+
+// consulKVPair is an entry in the response from the KV endpoint.
+type consulKVPair struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"` // base64 encoded
+}
+
+func (s *consulSource) Fetch(path string) (map[string]interface{}, string, error) {
+	path = strings.Trim(path, "/")
+
+	pairs, _, err := getConsulKV(context.Background(), path, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Watch waits for a missing key to be written, but reading one is an
+	// error, so that a mistyped path can't leave the command without it.
+	if pairs == nil {
+		return nil, "", fmt.Errorf("no consul key at or under %s", path)
+	}
+
+	secrets := map[string]interface{}{}
+	for _, pair := range pairs {
+		if pair.Key == path {
+			if values := parseSecretsValue(pair.Value); values != nil {
+				for k, v := range values {
+					secrets[k] = v
+				}
+			} else if len(s.key) > 0 {
+				secrets[s.key] = string(pair.Value)
+			} else {
+				return nil, "", fmt.Errorf("%s isn't a JSON object, so must be referenced with a #key to use as its name", path)
+			}
+			continue
+		}
+
+		// Folders have no value of their own.
+		name := strings.TrimPrefix(pair.Key, path+"/")
+		if name == pair.Key || len(name) == 0 || strings.HasSuffix(name, "/") {
+			continue
+		}
+		secrets[strings.Replace(name, "/", "_", -1)] = string(pair.Value)
+	}
+
+	return secrets, "", nil
+}
+
+func (s *consulSource) Renew(increment time.Duration) (time.Duration, error) {
+	return 0, nil
+}
+
+// Watch uses consul's blocking queries, so changes are seen as soon as they
+// are made rather than polled for.
+func (s *consulSource) Watch(path string, stop <-chan struct{}) error {
+	path = strings.Trim(path, "/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	_, initialIndex, err := getConsulKV(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+
+	for {
+		_, index, err := getConsulKV(ctx, path, initialIndex)
+		if ctx.Err() != nil {
+			return ErrWatchStopped
+		}
+		if err != nil {
+			return err
+		}
+		if index != initialIndex {
+			return nil
+		}
+	}
+}
+
+// consulAddress returns the URL of the consul agent.
+func consulAddress() string {
+	address := os.Getenv("CONSUL_HTTP_ADDR")
+	if len(address) == 0 {
+		address = defaultConsulAddress
+	}
+
+	if strings.Contains(address, "://") {
+		return strings.TrimRight(address, "/")
+	}
+
+	if ssl, _ := strconv.ParseBool(os.Getenv("CONSUL_HTTP_SSL")); ssl {
+		return "https://" + address
+	}
+	return "http://" + address
+}
+
+// getConsulKV returns every key at or under path (nil if there are none), and
+// the index of the data.  If index isn't 0, it's a blocking query that waits
+// until the data has changed from that index.
+func getConsulKV(ctx context.Context, path string, index uint64) ([]consulKVPair, uint64, error) {
+	url := consulAddress() + "/v1/kv/" + path + "?recurse=true"
+
+	timeout := consulRequestTimeout
+	if index > 0 {
+		url += fmt.Sprintf("&index=%d&wait=%s", index, consulWatchWait)
+		timeout += consulWatchWait
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); len(token) > 0 {
+		RedactToken(token)
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer zeroBytes(bodyBytes)
+
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, newIndex, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul error (HTTP status %d) reading %s: %s",
+			resp.StatusCode, path, strings.TrimSpace(string(bodyBytes)))
+	}
+
+	var pairs []consulKVPair
+	err = json.Unmarshal(bodyBytes, &pairs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return pairs, newIndex, nil
+}
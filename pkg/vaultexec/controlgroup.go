@@ -0,0 +1,117 @@
+package vaultexec
+
+// controlgroup.go includes waiting for control group approval (Vault
+// Enterprise).  A read of a path governed by a control group doesn't return
+// the secrets, but a wrapping token for them that can only be unwrapped once
+// enough approvers have authorized the request.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How often to check whether a control group request has been authorized.
+const controlGroupPollInterval = 5 * time.Second
+
+// VaultWrapInfo is the wrap_info of a response-wrapped response.
+type VaultWrapInfo struct {
+	Token        string `json:"token"`
+	Accessor     string `json:"accessor"`
+	TTL          int64  `json:"ttl"`
+	CreationPath string `json:"creation_path"`
+}
+
+// VaultControlGroupResponse handles fields we care about from checking a
+// control group request.
+type VaultControlGroupResponse struct {
+	Errors []string `json:"errors"`
+	Data   struct {
+		Approved bool `json:"approved"`
+	} `json:"data"`
+}
+
+// waitForControlGroup waits until the control group request for a read of
+// path is authorized (for up to config.ControlGroupTimeout, or the wrapping
+// token's TTL if that is sooner), then unwraps the response.
+func waitForControlGroup(path string, wrapInfo VaultWrapInfo, config VaultConfig) (VaultSecretResponse, error) {
+	RedactToken(wrapInfo.Token)
+
+	if config.ControlGroupTimeout <= 0 {
+		return VaultSecretResponse{}, fmt.Errorf(
+			"reading %s requires control group approval (accessor %s), set -control-group-timeout to wait for it",
+			path, wrapInfo.Accessor)
+	}
+
+	timeout := config.ControlGroupTimeout
+	if ttl := time.Duration(wrapInfo.TTL) * time.Second; ttl > 0 && ttl < timeout {
+		timeout = ttl
+	}
+	deadline := time.Now().Add(timeout)
+
+	LogInfof("Reading %s requires control group approval, waiting up to %s for accessor %s to be authorized",
+		path, timeout, wrapInfo.Accessor)
+
+	for {
+		approved, err := getControlGroupApproved(wrapInfo.Accessor, config)
+		if err != nil {
+			return VaultSecretResponse{}, fmt.Errorf("error checking control group approval for %s: %s", path, err)
+		}
+
+		if approved {
+			break
+		}
+
+		if time.Now().Add(controlGroupPollInterval).After(deadline) {
+			return VaultSecretResponse{}, fmt.Errorf(
+				"timed out after %s waiting for control group approval to read %s (accessor %s)",
+				timeout, path, wrapInfo.Accessor)
+		}
+
+		time.Sleep(controlGroupPollInterval)
+	}
+
+	LogInfof("Control group request for %s was authorized", path)
+
+	return unwrapVaultResponse(wrapInfo.Token, config)
+}
+
+// getControlGroupApproved returns whether a control group request has been
+// authorized.
+func getControlGroupApproved(accessor string, config VaultConfig) (bool, error) {
+	payload := map[string]string{"accessor": accessor}
+
+	bodyBytes, err := makeVaultRequest("POST", "v1/sys/control-group/request", payload, config)
+	if err != nil {
+		return false, err
+	}
+
+	var controlGroupResponse VaultControlGroupResponse
+	err = json.Unmarshal(bodyBytes, &controlGroupResponse)
+	if err != nil {
+		return false, err
+	}
+
+	if len(controlGroupResponse.Errors) > 0 {
+		return false, fmt.Errorf("vault server error: %s", strings.Join(controlGroupResponse.Errors, ","))
+	}
+
+	return controlGroupResponse.Data.Approved, nil
+}
+
+// unwrapVaultResponse returns the response wrapped by a wrapping token, which
+// is used as the token for unwrapping it.
+func unwrapVaultResponse(wrappingToken string, config VaultConfig) (VaultSecretResponse, error) {
+	var vaultSecretResponse VaultSecretResponse
+
+	config.Token = wrappingToken
+	bodyBytes, err := makeVaultRequest("POST", "v1/sys/wrapping/unwrap", nil, config)
+	if err != nil {
+		return vaultSecretResponse, err
+	}
+	defer zeroBytes(bodyBytes)
+
+	err = json.Unmarshal(bodyBytes, &vaultSecretResponse)
+	return vaultSecretResponse, err
+}
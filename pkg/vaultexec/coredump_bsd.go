@@ -0,0 +1,27 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package vaultexec
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// DisableCoreDumps stops vaultexec from writing a core dump, which would
+// contain the token and secrets, if it crashes.  The command inherits the
+// limit.  Unlike on linux, attaching with ptrace isn't prevented.
+func DisableCoreDumps() error {
+	// Only the soft limit is lowered, so the command can still raise it (e.g.
+	// with ulimit -c) to debug its own crashes.
+	var limit syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_CORE, &limit)
+	if err == nil {
+		limit.Cur = 0
+		err = syscall.Setrlimit(syscall.RLIMIT_CORE, &limit)
+	}
+	if err != nil {
+		return fmt.Errorf("error disabling core dumps: %s", err)
+	}
+	return nil
+}
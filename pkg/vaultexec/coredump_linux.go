@@ -0,0 +1,35 @@
+package vaultexec
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// From linux/prctl.h.
+const prSetDumpable = 4
+
+// DisableCoreDumps stops vaultexec from writing a core dump if it crashes, and
+// marks it as not dumpable so that processes running as the same user can't
+// attach to it with ptrace or read its memory from /proc, either of which
+// would expose the token and secrets.  The command inherits the core dump
+// limit, but not the dumpable flag, which is reset when it's executed.
+func DisableCoreDumps() error {
+	// Only the soft limit is lowered, so the command can still raise it (e.g.
+	// with ulimit -c) to debug its own crashes.
+	var limit syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_CORE, &limit)
+	if err == nil {
+		limit.Cur = 0
+		err = syscall.Setrlimit(syscall.RLIMIT_CORE, &limit)
+	}
+	if err != nil {
+		return fmt.Errorf("error disabling core dumps: %s", err)
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetDumpable, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("error disabling ptrace: %s", errno)
+	}
+
+	return nil
+}
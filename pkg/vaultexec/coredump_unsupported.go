@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package vaultexec
+
+import (
+	"errors"
+	"runtime"
+)
+
+// DisableCoreDumps returns an error, since disabling core dumps isn't
+// supported on this platform.
+func DisableCoreDumps() error {
+	return errors.New("disabling core dumps is not supported on " + runtime.GOOS)
+}
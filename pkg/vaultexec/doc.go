@@ -0,0 +1,36 @@
+// Package vaultexec fetches secrets from vault and runs commands with them as
+// environment variables.  It is what the vaultexec command is built on, and
+// can be used to do the same from other Go programs without running the
+// vaultexec binary:
+//
+//	config, err := vaultexec.NewVaultConfig(vaultexec.VaultConfig{
+//	    Path:      "secret/my-app/all,secret/shared/all",
+//	    PathDelim: ",",
+//	})
+//	if err != nil {
+//	    return err
+//	}
+//	if err = vaultexec.ValidateVaultConfig(config); err != nil {
+//	    return err
+//	}
+//	config, err = vaultexec.WithVaultClient(config)
+//	if err != nil {
+//	    return err
+//	}
+//
+//	secrets, err := vaultexec.GetVaultSecrets(config)
+//	if err != nil {
+//	    return err
+//	}
+//
+//	go vaultexec.KeepVaultTokenRenewed(config, 0)
+//	return vaultexec.RunWithEnvVars([]string{"my-app"}, secrets.Values)
+//
+// NewVaultConfig fills in anything not set in the given config from the
+// standard VAULT_ environment variables (VAULT_ADDR, VAULT_TOKEN, ...), and
+// fields left at their zero value (e.g. RequestTimeout) mean no limit, so
+// start from the Default values where that matters.  Errors from vault
+// rejecting the token are returned as a *VaultAuthError.
+//
+// Messages are logged with the standard log package, see SetLogLevel.
+package vaultexec
@@ -0,0 +1,56 @@
+package vaultexec
+
+// execcredential.go includes the Kubernetes ExecCredential format, so that
+// vaultexec fetch can be used as a kubectl exec credential plugin for clusters
+// whose tokens are stored in vault.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The API version used when kubectl doesn't say which it wants.
+const defaultExecCredentialAPIVersion = "client.authentication.k8s.io/v1"
+
+// ExecCredential is the response of an exec credential plugin.
+type ExecCredential struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Status     ExecCredentialStatus `json:"status"`
+}
+
+// ExecCredentialStatus holds the credential in an ExecCredential.
+type ExecCredentialStatus struct {
+	Token string `json:"token"`
+}
+
+// NewExecCredential returns an ExecCredential holding token, in the API
+// version that kubectl asked for in KUBERNETES_EXEC_INFO.
+func NewExecCredential(token string) (ExecCredential, error) {
+	apiVersion := defaultExecCredentialAPIVersion
+
+	if execInfo := os.Getenv("KUBERNETES_EXEC_INFO"); len(execInfo) > 0 {
+		var info struct {
+			APIVersion string `json:"apiVersion"`
+		}
+		err := json.Unmarshal([]byte(execInfo), &info)
+		if err != nil {
+			return ExecCredential{}, fmt.Errorf("invalid KUBERNETES_EXEC_INFO: %s", err)
+		}
+		if len(info.APIVersion) > 0 {
+			apiVersion = info.APIVersion
+		}
+	}
+
+	if !strings.HasPrefix(apiVersion, "client.authentication.k8s.io/") {
+		return ExecCredential{}, fmt.Errorf("unsupported exec credential API version %s", apiVersion)
+	}
+
+	return ExecCredential{
+		APIVersion: apiVersion,
+		Kind:       "ExecCredential",
+		Status:     ExecCredentialStatus{Token: token},
+	}, nil
+}
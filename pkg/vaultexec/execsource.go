@@ -0,0 +1,135 @@
+package vaultexec
+
+// execsource.go includes a SecretSource that runs a plugin command for every
+// request, so that custom backends can be added without changing vaultexec.
+// The plugin is sent a JSON request on stdin:
+//
+//     {"method": "fetch", "path": "app/db"}
+//     {"method": "renew", "increment": 3600}
+//     {"method": "watch", "path": "app/db"}
+//
+// and must write a JSON response to stdout, with any problem reported as an
+// error:
+//
+//     {"data": {"USER": "app"}, "lease_id": ""}
+//     {"lease_duration": 3600}
+//     {"error": "permission denied"}
+//
+// A watch request should only be answered once the secrets at the path may
+// have changed.  Durations are in seconds.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// execSourceRequest is sent to a plugin on stdin.
+type execSourceRequest struct {
+	Method    string `json:"method"`
+	Path      string `json:"path,omitempty"`
+	Increment int64  `json:"increment,omitempty"`
+}
+
+// execSourceResponse is read from a plugin's stdout.
+type execSourceResponse struct {
+	Error         string                 `json:"error"`
+	Data          map[string]interface{} `json:"data"`
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int64                  `json:"lease_duration"`
+}
+
+// execSource is a SecretSource backed by a plugin command.
+type execSource struct {
+	args []string
+}
+
+// NewExecSecretSource returns a SecretSource that runs the plugin command line
+// (e.g. "vaultexec-source-aws --region us-east-1") for every request.
+func NewExecSecretSource(command string) (SecretSource, error) {
+	args, err := splitCommandLine(command)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret source command: %s", err)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("invalid secret source command: empty command")
+	}
+
+	return &execSource{args: args}, nil
+}
+
+func (s *execSource) Fetch(path string) (map[string]interface{}, string, error) {
+	resp, err := s.request(execSourceRequest{Method: "fetch", Path: path}, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp.Data, resp.LeaseID, nil
+}
+
+func (s *execSource) Renew(increment time.Duration) (time.Duration, error) {
+	resp, err := s.request(execSourceRequest{Method: "renew", Increment: int64(increment / time.Second)}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(resp.LeaseDuration) * time.Second, nil
+}
+
+func (s *execSource) Watch(path string, stop <-chan struct{}) error {
+	_, err := s.request(execSourceRequest{Method: "watch", Path: path}, stop)
+	return err
+}
+
+// request runs the plugin with a single request and returns its response.  If
+// stop is closed first the plugin is killed and ErrWatchStopped is returned.
+func (s *execSource) request(req execSourceRequest, stop <-chan struct{}) (*execSourceResponse, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdoutBytes bytes.Buffer
+	cmd := exec.Command(s.args[0], s.args[1:]...)
+	cmd.Stdin = bytes.NewReader(reqBytes)
+	cmd.Stdout = &stdoutBytes
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("error running secret source %s: %s", s.args[0], err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-stop:
+		cmd.Process.Kill()
+		<-done
+		return nil, ErrWatchStopped
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error running secret source %s: %s", s.args[0], err)
+	}
+
+	var resp execSourceResponse
+	err = json.Unmarshal(stdoutBytes.Bytes(), &resp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from secret source %s: %s", s.args[0], err)
+	}
+
+	if len(resp.Error) > 0 {
+		return nil, fmt.Errorf("secret source %s error: %s", s.args[0], resp.Error)
+	}
+
+	return &resp, nil
+}
@@ -0,0 +1,84 @@
+package vaultexec
+
+// failover.go includes functions for spreading requests across multiple vault
+// server addresses, failing over to the next one when a server is unavailable.
+
+import (
+	"strings"
+)
+
+// splitVaultAddresses splits a comma separated list of vault server addresses,
+// removing any whitespace and trailing slashes.
+func splitVaultAddresses(address string) []string {
+	var addresses []string
+
+	for _, a := range strings.Split(address, ",") {
+		a = strings.TrimRight(strings.TrimSpace(a), "/")
+		if len(a) > 0 {
+			addresses = append(addresses, a)
+		}
+	}
+
+	return addresses
+}
+
+// orderedAddresses returns the addresses to try for a request, starting with
+// the one that most recently answered successfully.
+func (client *vaultClient) orderedAddresses() []string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	ordered := make([]string, 0, len(client.addresses))
+	for i := range client.addresses {
+		ordered = append(ordered, client.addresses[(client.healthyAddress+i)%len(client.addresses)])
+	}
+
+	return ordered
+}
+
+// markHealthy records that an address answered successfully, so that it will
+// be tried first for subsequent requests.
+func (client *vaultClient) markHealthy(address string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	for i, a := range client.addresses {
+		if a == address {
+			client.healthyAddress = i
+			return
+		}
+	}
+}
+
+// shouldFailover determines whether a request failed in a way that another
+// vault server may be able to handle: connection errors and server errors.
+func shouldFailover(resp *vaultResponse, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// doVaultRequestWithFailover makes a request to each vault server address in
+// turn until one of them is able to handle it.  The last response (or error)
+// is returned if every server fails.
+func doVaultRequestWithFailover(client *vaultClient, method string, path string, payloadBytes []byte, config VaultConfig) (*vaultResponse, error) {
+	var resp *vaultResponse
+	var err error
+
+	addresses := client.orderedAddresses()
+
+	for i, address := range addresses {
+		client.limiter.Wait()
+
+		resp, err = doVaultRequest(client, method, address+"/"+path, payloadBytes, config)
+
+		if !shouldFailover(resp, err) {
+			client.markHealthy(address)
+			break
+		}
+
+		if i < len(addresses)-1 {
+			LogWarnf("Vault server %s unavailable, failing over to %s", address, addresses[i+1])
+		}
+	}
+
+	return resp, err
+}
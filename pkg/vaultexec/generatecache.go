@@ -0,0 +1,97 @@
+package vaultexec
+
+// generatecache.go includes functions for caching the output of the
+// generate-config command, so that expensive generators aren't run on every
+// invocation of vaultexec on the same host.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default time that cached generate-config output is reused for.
+const DefaultGenerateConfigTTL = 5 * time.Minute
+
+// generateConfigCache is the format of the cache file.  The command and a hash
+// of the environment it was given (see configGeneratorEnv) are stored so that
+// changing either, e.g. running a different command, invalidates the cache.
+type generateConfigCache struct {
+	Command string          `json:"command"`
+	Shell   bool            `json:"shell"`
+	Env     string          `json:"env"`
+	Output  json.RawMessage `json:"output"`
+}
+
+// readGenerateConfigCache returns the cached output of the generate-config
+// command, if there is a cache file that hasn't expired for the same command
+// and environment.
+func readGenerateConfigCache(options GenerateConfigOptions, env []string) ([]byte, bool) {
+	if len(options.CacheFile) == 0 {
+		return nil, false
+	}
+
+	fileInfo, err := os.Stat(options.CacheFile)
+	if err != nil || time.Since(fileInfo.ModTime()) > options.CacheTTL {
+		return nil, false
+	}
+
+	cacheBytes, err := ioutil.ReadFile(options.CacheFile)
+	if err != nil {
+		return nil, false
+	}
+
+	var cache generateConfigCache
+	err = json.Unmarshal(cacheBytes, &cache)
+	if err != nil || cache.Command != options.Command || cache.Shell != options.Shell || cache.Env != generatorEnvHash(env) {
+		return nil, false
+	}
+
+	return cache.Output, true
+}
+
+// writeGenerateConfigCache stores the output of the generate-config command.
+// The output usually includes a token, so the file is only readable by the
+// current user, and is replaced atomically so that concurrent invocations
+// never read a partial file.
+func writeGenerateConfigCache(options GenerateConfigOptions, env []string, output []byte) error {
+	cacheBytes, err := json.Marshal(generateConfigCache{
+		Command: options.Command,
+		Shell:   options.Shell,
+		Env:     generatorEnvHash(env),
+		Output:  output,
+	})
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(options.CacheFile), filepath.Base(options.CacheFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	// TempFile creates the file with 0600 permissions.
+	_, err = tempFile.Write(cacheBytes)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), options.CacheFile)
+}
+
+// generatorEnvHash returns a hash of the generate-config command's environment,
+// which is stored rather than the environment itself since it can include the
+// token.
+func generatorEnvHash(env []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(env, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,91 @@
+package vaultexec
+
+// health.go includes functions for checking that the vault server is ready to
+// serve requests.
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// How often to poll sys/health while waiting for vault to become ready.
+const waitForVaultInterval = 2 * time.Second
+
+// VaultHealthResponse handles fields we care about from sys/health.
+type VaultHealthResponse struct {
+	Errors             []string `json:"errors"`
+	Initialized        bool     `json:"initialized"`
+	Sealed             bool     `json:"sealed"`
+	Standby            bool     `json:"standby"`
+	PerformanceStandby bool     `json:"performance_standby"`
+}
+
+// GetVaultHealth returns the health status of the vault server.  Standby nodes
+// are reported as healthy, and must be checked with the Standby field.
+func GetVaultHealth(config VaultConfig) (VaultHealthResponse, error) {
+	var vaultHealthResponse VaultHealthResponse
+
+	bodyBytes, err := makeVaultRequest("GET", "v1/sys/health?standbyok=true&perfstandbyok=true", nil, config)
+
+	if err != nil {
+		return vaultHealthResponse, err
+	}
+
+	err = json.Unmarshal(bodyBytes, &vaultHealthResponse)
+
+	if err != nil {
+		return vaultHealthResponse, err
+	}
+
+	return vaultHealthResponse, nil
+}
+
+// vaultNotReadyReason returns why vault is not ready to serve requests, or an
+// empty string if it is ready.
+func vaultNotReadyReason(health VaultHealthResponse, requireActive bool) string {
+	if !health.Initialized {
+		return "not initialized"
+	}
+	if health.Sealed {
+		return "sealed"
+	}
+	if requireActive && (health.Standby || health.PerformanceStandby) {
+		return "a standby node"
+	}
+	return ""
+}
+
+// WaitForVault polls sys/health until the vault server is initialized and
+// unsealed (and the active node, if requireActive is set), or returns an error
+// once timeout has passed.
+func WaitForVault(config VaultConfig, timeout time.Duration, requireActive bool) error {
+	deadline := time.Now().Add(timeout)
+	lastReason := ""
+
+	for {
+		health, err := GetVaultHealth(config)
+
+		reason := ""
+		if err != nil {
+			reason = fmt.Sprintf("unreachable: %s", err)
+		} else {
+			reason = vaultNotReadyReason(health, requireActive)
+		}
+
+		if len(reason) == 0 {
+			return nil
+		}
+
+		if time.Now().Add(waitForVaultInterval).After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for vault, server is %s", timeout, reason)
+		}
+
+		if reason != lastReason {
+			LogInfof("Waiting for vault, server is %s", reason)
+			lastReason = reason
+		}
+
+		time.Sleep(waitForVaultInterval)
+	}
+}
@@ -0,0 +1,278 @@
+package vaultexec
+
+// httpsource.go includes a SecretSource that reads secrets from any HTTP API
+// that responds with JSON, e.g. 1Password Connect or Doppler, configured with
+// a URL, headers, and a JSONPath to the secrets in the response:
+//
+//     https://connect:8080/v1/vaults/VAULT_ID/items/{path} \
+//         "header=Authorization: Bearer ${OP_CONNECT_TOKEN}" jsonpath=$.fields
+//
+// {path} is replaced by the referenced path, and $VAR or ${VAR} in a header
+// by the environment variable, so that credentials needn't be in the options.
+// The JSONPath can select an object of secrets, or an array of objects that
+// each have a label, name, or key, and a value (like 1Password's fields).
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a request to an HTTP source can take.
+const httpSourceRequestTimeout = 30 * time.Second
+
+// httpSource is a SecretSource backed by an HTTP JSON API.
+type httpSource struct {
+	url      string
+	headers  []string // "Name: value", expanded for every request
+	jsonPath string
+}
+
+// NewHTTPSecretSource returns a SecretSource that reads from an HTTP JSON API,
+// configured by a URL followed by any header=Name: value and jsonpath=...
+// options (quoted like a command line).
+func NewHTTPSecretSource(spec string) (SecretSource, error) {
+	args, err := splitCommandLine(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP secret source: %s", err)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("invalid HTTP secret source: missing URL")
+	}
+
+	u, err := url.Parse(strings.Replace(args[0], "{path}", "path", -1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid HTTP secret source URL %s, must be http:// or https://", args[0])
+	}
+
+	source := &httpSource{url: args[0], jsonPath: "$"}
+
+	for _, option := range args[1:] {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid HTTP secret source option %q, must be header=... or jsonpath=...", option)
+		}
+
+		switch parts[0] {
+		case "header":
+			if !strings.Contains(parts[1], ":") {
+				return nil, fmt.Errorf("invalid HTTP secret source header %q, must be in the form \"Name: value\"", parts[1])
+			}
+			source.headers = append(source.headers, parts[1])
+		case "jsonpath":
+			_, err = parseJSONPath(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			source.jsonPath = parts[1]
+		default:
+			return nil, fmt.Errorf("invalid HTTP secret source option %q, must be header=... or jsonpath=...", option)
+		}
+	}
+
+	return source, nil
+}
+
+func (s *httpSource) Fetch(path string) (map[string]interface{}, string, error) {
+	bodyBytes, err := s.get(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer zeroBytes(bodyBytes)
+
+	var body interface{}
+	err = json.Unmarshal(bodyBytes, &body)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid JSON reading %s: %s", path, err)
+	}
+
+	selected, err := evaluateJSONPath(body, s.jsonPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	secrets, err := httpSourceSecrets(selected)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	return secrets, "", nil
+}
+
+func (s *httpSource) Renew(increment time.Duration) (time.Duration, error) {
+	return 0, nil
+}
+
+// Watch polls the path every DefaultWatchInterval, until the response changes.
+func (s *httpSource) Watch(path string, stop <-chan struct{}) error {
+	initial, err := s.get(path)
+	if err != nil {
+		return err
+	}
+	initialHash := sha256.Sum256(initial)
+	zeroBytes(initial)
+
+	return pollUntilChanged(stop, func() (bool, error) {
+		current, err := s.get(path)
+		defer zeroBytes(current)
+		return sha256.Sum256(current) != initialHash, err
+	})
+}
+
+// get returns the response for a path.
+func (s *httpSource) get(path string) ([]byte, error) {
+	requestURL := s.url
+	if strings.Contains(requestURL, "{path}") {
+		requestURL = strings.Replace(requestURL, "{path}", path, -1)
+	} else {
+		requestURL = strings.TrimRight(requestURL, "/") + "/" + path
+	}
+
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	for _, header := range s.headers {
+		parts := strings.SplitN(os.ExpandEnv(header), ":", 2)
+		value := strings.TrimSpace(parts[1])
+		RedactToken(value)
+		req.Header.Add(strings.TrimSpace(parts[0]), value)
+	}
+
+	client := &http.Client{Timeout: httpSourceRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		zeroBytes(bodyBytes)
+		return nil, fmt.Errorf("HTTP status %d reading %s", resp.StatusCode, path)
+	}
+
+	return bodyBytes, nil
+}
+
+// httpSourceSecrets returns the secrets in the part of a response selected by
+// the JSONPath.
+func httpSourceSecrets(selected interface{}) (map[string]interface{}, error) {
+	switch v := selected.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case []interface{}:
+		secrets := map[string]interface{}{}
+		for _, item := range v {
+			field, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("the JSONPath must select an object, or an array of objects")
+			}
+
+			value, ok := field["value"]
+			if !ok {
+				continue
+			}
+			for _, name := range []string{"label", "name", "key"} {
+				if key, ok := field[name].(string); ok && len(key) > 0 {
+					secrets[key] = value
+					break
+				}
+			}
+		}
+		return secrets, nil
+	}
+
+	return nil, errors.New("the JSONPath must select an object, or an array of objects")
+}
+
+// parseJSONPath parses the subset of JSONPath that's supported: $ followed by
+// any .name, ['name'], and [index] steps, e.g. $.data.fields or $['data'][0].
+// Each step is returned as a string for a name, or an int for an index.
+func parseJSONPath(path string) ([]interface{}, error) {
+	invalid := fmt.Errorf("invalid JSONPath %s, must be like $.name, $['name'], or $[0]", path)
+
+	if !strings.HasPrefix(path, "$") {
+		return nil, invalid
+	}
+	rest := path[1:]
+
+	var steps []interface{}
+	for len(rest) > 0 {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if len(name) == 0 {
+				return nil, invalid
+			}
+			steps = append(steps, name)
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, invalid
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, inner[1:len(inner)-1])
+			} else if index, err := strconv.Atoi(inner); err == nil && index >= 0 {
+				steps = append(steps, index)
+			} else {
+				return nil, invalid
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, invalid
+		}
+	}
+
+	return steps, nil
+}
+
+// evaluateJSONPath returns the part of a JSON document selected by path.
+func evaluateJSONPath(document interface{}, path string) (interface{}, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	current := document
+	for _, step := range steps {
+		switch s := step.(type) {
+		case string:
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not in the response", path)
+			}
+			if current, ok = object[s]; !ok {
+				return nil, fmt.Errorf("%s is not in the response", path)
+			}
+		case int:
+			array, ok := current.([]interface{})
+			if !ok || s >= len(array) {
+				return nil, fmt.Errorf("%s is not in the response", path)
+			}
+			current = array[s]
+		}
+	}
+
+	return current, nil
+}
@@ -0,0 +1,60 @@
+package vaultexec
+
+// keynaming.go includes envconsul's conventions for naming the keys of the
+// secrets, so that an application launched with envconsul can be launched
+// with vaultexec without renaming any of its environment variables.
+
+import (
+	"regexp"
+	"strings"
+)
+
+// KeyNaming changes how the keys of the secrets are named, with the same
+// options (and in the same order) as envconsul.
+type KeyNaming struct {
+	// Prefix the keys read from vault with their path, with any "/" replaced
+	// by "_", e.g. password at secret/my-app is secret_my-app_password.  This
+	// is envconsul's default for vault secrets.  Keys from other sources
+	// (e.g. consul://) are named as they are, like envconsul's prefixes.
+	PathPrefix bool
+
+	// Replace any character that isn't valid in an environment variable name
+	// with "_", like envconsul's -sanitize.
+	Sanitize bool
+
+	// Convert the keys to upper case, like envconsul's -upcase.
+	Upcase bool
+}
+
+// The characters that envconsul's -sanitize replaces.
+var invalidKeyCharacters = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// keyName returns the name of a key read from path.
+func (n KeyNaming) keyName(path string, key string) string {
+	if n.PathPrefix {
+		ref, err := parseSecretReference(path)
+		if err == nil && ref.Source == vaultSourceName {
+			prefix := strings.Trim(strings.TrimSpace(ref.Path), "/")
+			key = strings.Replace(prefix, "/", "_", -1) + "_" + key
+		}
+	}
+
+	if n.Sanitize {
+		key = invalidKeyCharacters.ReplaceAllString(key, "_")
+	}
+
+	if n.Upcase {
+		key = strings.ToUpper(key)
+	}
+
+	return key
+}
+
+// The names that a shell accepts for a variable.
+var shellVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// IsShellVariableName returns whether key can be assigned as a shell variable,
+// e.g. in output that will be sourced.
+func IsShellVariableName(key string) bool {
+	return shellVariableName.MatchString(key)
+}
@@ -0,0 +1,60 @@
+package vaultexec
+
+// logdest.go includes functions for sending vaultexec's own logs somewhere
+// other than stderr, leaving the command's stdout and stderr untouched.
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// reopenableFile is a log file that can be reopened, e.g. after it has been
+// moved aside by logrotate.
+type reopenableFile struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+func (f *reopenableFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Write(p)
+}
+
+// Reopen closes the log file and opens it again at the same path.
+func (f *reopenableFile) Reopen() error {
+	file, err := openLogFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.file.Close()
+	f.file = file
+
+	return nil
+}
+
+// SetLogFile sends vaultexec's logs to the file at path, which is appended to.
+// Where supported, the file is reopened when vaultexec receives SIGUSR1.
+func SetLogFile(path string) error {
+	file, err := openLogFile(path)
+	if err != nil {
+		return err
+	}
+
+	logFile := &reopenableFile{path: path, file: file}
+	log.SetOutput(logFile)
+
+	reopenLogFileOnSignal(logFile)
+
+	return nil
+}
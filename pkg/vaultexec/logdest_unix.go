@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+package vaultexec
+
+import (
+	"log"
+	"log/syslog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reopenLogFileOnSignal reopens the log file whenever vaultexec receives
+// SIGUSR1, so that log rotation doesn't require restarting the command.
+func reopenLogFileOnSignal(logFile *reopenableFile) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+
+	go func() {
+		for range sigs {
+			err := logFile.Reopen()
+			if err != nil {
+				LogErrorf("error reopening log file: %s", err)
+			}
+		}
+	}()
+}
+
+// SetLogSyslog sends vaultexec's logs to the local syslog daemon (or journald).
+func SetLogSyslog() error {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "vaultexec")
+	if err != nil {
+		return err
+	}
+
+	// Syslog adds its own timestamps.
+	log.SetFlags(0)
+	log.SetOutput(writer)
+
+	return nil
+}
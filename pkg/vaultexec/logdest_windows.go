@@ -0,0 +1,13 @@
+package vaultexec
+
+import (
+	"errors"
+)
+
+// reopenLogFileOnSignal does nothing, since there is no SIGUSR1 on windows.
+func reopenLogFileOnSignal(logFile *reopenableFile) {}
+
+// SetLogSyslog returns an error, since there is no syslog on windows.
+func SetLogSyslog() error {
+	return errors.New("logging to syslog is not supported on windows")
+}
@@ -0,0 +1,62 @@
+package vaultexec
+
+// logging.go includes leveled logging for vaultexec's own messages.  Nothing
+// logged should ever include a token or secret value; debug messages name
+// options and keys, never their values, and every message is passed through
+// Redact in case an error includes one.
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Log levels, from most to least verbose.
+const (
+	LogLevelDebug = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// The current log level, see SetLogLevel.
+var logLevel = LogLevelInfo
+
+// SetLogLevel sets the log level by name: debug, info, warn, or error.
+func SetLogLevel(name string) error {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			logLevel = level
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log level %s, must be one of: %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// LogDebugf logs a message that is only useful when troubleshooting.
+func LogDebugf(format string, v ...interface{}) {
+	if logLevel <= LogLevelDebug {
+		log.Print("VaultExec - DEBUG " + Redact(fmt.Sprintf(format, v...)))
+	}
+}
+
+// LogInfof logs routine messages about what vaultexec is doing.
+func LogInfof(format string, v ...interface{}) {
+	if logLevel <= LogLevelInfo {
+		log.Print("VaultExec - " + Redact(fmt.Sprintf(format, v...)))
+	}
+}
+
+// LogWarnf logs problems that vaultexec is able to recover from.
+func LogWarnf(format string, v ...interface{}) {
+	if logLevel <= LogLevelWarn {
+		log.Print("VaultExec - " + Redact(fmt.Sprintf(format, v...)))
+	}
+}
+
+// LogErrorf logs errors, which are always shown.
+func LogErrorf(format string, v ...interface{}) {
+	log.Print(Redact(fmt.Sprintf(format, v...)))
+}
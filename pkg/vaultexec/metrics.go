@@ -0,0 +1,173 @@
+package vaultexec
+
+// metrics.go includes the metrics that vaultexec keeps about fetching secrets,
+// renewing the token, and the command it runs, which can be served for
+// Prometheus to scrape in its text exposition format, or sent to statsd (see
+// statsd.go), and are also used for health checks (see probe.go).
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the fetch duration histogram buckets, in seconds.
+var fetchDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// vaultexecMetrics holds every metric.
+type vaultexecMetrics struct {
+	mutex sync.Mutex
+
+	fetchBucketCounts []uint64
+	fetchCount        uint64
+	fetchSum          float64
+	fetchFailures     uint64
+	lastFetch         time.Time
+
+	renewals        uint64
+	renewalFailures uint64
+	renewalError    error
+	tokenExpiry     time.Time
+
+	childStarted  time.Time
+	childRunning  bool
+	startupPolicy string
+}
+
+var metrics = &vaultexecMetrics{
+	fetchBucketCounts: make([]uint64, len(fetchDurationBuckets)),
+}
+
+// recordFetch records the time taken to fetch every secret path.
+func (m *vaultexecMetrics) recordFetch(duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err != nil {
+		m.fetchFailures++
+		sendStatsd("fetch.failures", 1, "c")
+		return
+	}
+
+	sendStatsd("fetch.count", 1, "c")
+	sendStatsd("fetch.duration", duration.Seconds()*1000, "ms")
+
+	seconds := duration.Seconds()
+	for i, bucket := range fetchDurationBuckets {
+		if seconds <= bucket {
+			m.fetchBucketCounts[i]++
+		}
+	}
+	m.fetchCount++
+	m.fetchSum += seconds
+	m.lastFetch = time.Now()
+}
+
+// recordRenewal records an attempt to renew the token, and how long the token
+// is valid for if it succeeded.
+func (m *vaultexecMetrics) recordRenewal(leaseDuration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err != nil {
+		m.renewalFailures++
+		m.renewalError = err
+		sendStatsd("token.renewal.failure", 1, "c")
+		return
+	}
+
+	sendStatsd("token.renewal.success", 1, "c")
+	sendStatsd("token.ttl", leaseDuration.Seconds(), "g")
+
+	m.renewals++
+	m.renewalError = nil
+	m.tokenExpiry = time.Now().Add(leaseDuration)
+}
+
+// recordChild records the command starting or exiting.
+func (m *vaultexecMetrics) recordChild(running bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.childRunning = running
+	if running {
+		m.childStarted = time.Now()
+	}
+}
+
+// recordChildExit records the command's exit code.  This is only sent to
+// statsd, since Prometheus can't scrape a command that has exited.
+func (m *vaultexecMetrics) recordChildExit(exitCode int) {
+	sendStatsd("child.exit", 1, "c")
+	sendStatsd("child.exit_code", float64(exitCode), "g")
+}
+
+// write writes every metric in the Prometheus text exposition format.
+func (m *vaultexecMetrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP vaultexec_fetch_duration_seconds Time taken to fetch every secret path.\n")
+	fmt.Fprintf(w, "# TYPE vaultexec_fetch_duration_seconds histogram\n")
+	for i, bucket := range fetchDurationBuckets {
+		fmt.Fprintf(w, "vaultexec_fetch_duration_seconds_bucket{le=\"%g\"} %d\n", bucket, m.fetchBucketCounts[i])
+	}
+	fmt.Fprintf(w, "vaultexec_fetch_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.fetchCount)
+	fmt.Fprintf(w, "vaultexec_fetch_duration_seconds_sum %g\n", m.fetchSum)
+	fmt.Fprintf(w, "vaultexec_fetch_duration_seconds_count %d\n", m.fetchCount)
+
+	fmt.Fprintf(w, "# HELP vaultexec_fetch_failures_total Failed attempts to fetch the secrets.\n")
+	fmt.Fprintf(w, "# TYPE vaultexec_fetch_failures_total counter\n")
+	fmt.Fprintf(w, "vaultexec_fetch_failures_total %d\n", m.fetchFailures)
+
+	fmt.Fprintf(w, "# HELP vaultexec_token_renewals_total Attempts to renew the token, by result.\n")
+	fmt.Fprintf(w, "# TYPE vaultexec_token_renewals_total counter\n")
+	fmt.Fprintf(w, "vaultexec_token_renewals_total{result=\"success\"} %d\n", m.renewals)
+	fmt.Fprintf(w, "vaultexec_token_renewals_total{result=\"failure\"} %d\n", m.renewalFailures)
+
+	ttl := 0.0
+	if !m.tokenExpiry.IsZero() {
+		ttl = time.Until(m.tokenExpiry).Seconds()
+	}
+	fmt.Fprintf(w, "# HELP vaultexec_token_ttl_seconds Time until the token's lease expires, as of the last renewal.\n")
+	fmt.Fprintf(w, "# TYPE vaultexec_token_ttl_seconds gauge\n")
+	fmt.Fprintf(w, "vaultexec_token_ttl_seconds %g\n", ttl)
+
+	running, uptime := 0, 0.0
+	if m.childRunning {
+		running, uptime = 1, time.Since(m.childStarted).Seconds()
+	}
+	fmt.Fprintf(w, "# HELP vaultexec_child_running Whether the command is running.\n")
+	fmt.Fprintf(w, "# TYPE vaultexec_child_running gauge\n")
+	fmt.Fprintf(w, "vaultexec_child_running %d\n", running)
+	fmt.Fprintf(w, "# HELP vaultexec_child_uptime_seconds Time since the command was started.\n")
+	fmt.Fprintf(w, "# TYPE vaultexec_child_uptime_seconds gauge\n")
+	fmt.Fprintf(w, "vaultexec_child_uptime_seconds %g\n", uptime)
+}
+
+// ServeMetrics serves the metrics for Prometheus at /metrics on addr (e.g.
+// :9090) in the background, returning an error if it can't listen there.
+func ServeMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error serving metrics: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			LogErrorf("error serving metrics: %s", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package vaultexec
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// LockMemory locks all of vaultexec's memory, current and future, into RAM so
+// that the token and secrets can't be swapped to disk.  This requires the
+// IPC_LOCK capability (or a high enough memlock limit).
+func LockMemory() error {
+	err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE)
+	if err != nil {
+		return fmt.Errorf("error locking memory (the IPC_LOCK capability may be required): %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package vaultexec
+
+import (
+	"errors"
+	"runtime"
+)
+
+// LockMemory returns an error, since locking memory is only supported on linux
+// (macOS doesn't implement mlockall).
+func LockMemory() error {
+	return errors.New("locking memory is not supported on " + runtime.GOOS)
+}
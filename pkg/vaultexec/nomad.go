@@ -0,0 +1,113 @@
+package vaultexec
+
+// nomad.go includes logging in to vault with a Nomad task's workload identity,
+// through the JWT auth method that Nomad's vault integration sets up (e.g.
+// with nomad setup vault), so that vaultexec can be the entrypoint of tasks
+// that don't use Nomad's own vault block.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultNomadAuthMount is where nomad setup vault mounts the JWT auth method.
+const DefaultNomadAuthMount = "jwt-nomad"
+
+// NomadOptions configures logging in with a Nomad workload identity.
+type NomadOptions struct {
+	Enabled   bool
+	AuthMount string // The path the JWT auth method is mounted at
+	Role      string // The role to log in with, empty for the mount's default role
+}
+
+// VaultLoginResponse is the response of logging in with an auth method.
+type VaultLoginResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// NomadWorkloadIdentity returns the task's workload identity for vault,
+// preferring the vault_default identity that Nomad creates for vault (with
+// env = true or file = true in its identity block) over the task's default
+// identity.
+func NomadWorkloadIdentity() (string, error) {
+	secretsDir := os.Getenv("NOMAD_SECRETS_DIR")
+
+	for _, identity := range []struct {
+		env  string
+		file string
+	}{
+		{"NOMAD_TOKEN_vault_default", "nomad_vault_default.jwt"},
+		{"NOMAD_TOKEN", "nomad_token"},
+	} {
+		if jwt := os.Getenv(identity.env); len(jwt) > 0 {
+			LogDebugf("Using the Nomad workload identity from %s", identity.env)
+			return jwt, nil
+		}
+
+		if len(secretsDir) == 0 {
+			continue
+		}
+
+		jwtBytes, err := ioutil.ReadFile(filepath.Join(secretsDir, identity.file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		LogDebugf("Using the Nomad workload identity from %s", identity.file)
+		return strings.TrimSpace(string(jwtBytes)), nil
+	}
+
+	return "", errors.New("no Nomad workload identity, give the task an identity with env = true or file = true")
+}
+
+// LoginWithJWT logs in to vault with a JWT (e.g. a Nomad workload identity)
+// through the JWT auth method mounted at mount, and returns the new token.
+func LoginWithJWT(config VaultConfig, mount string, role string, jwt string) (string, error) {
+	RedactToken(jwt)
+
+	payload := map[string]string{"jwt": jwt}
+	if len(role) > 0 {
+		payload["role"] = role
+	}
+
+	// The login request is made without a token.
+	config.Token = ""
+	mount = strings.Trim(mount, "/")
+	bodyBytes, err := makeVaultRequest("POST", "v1/auth/"+mount+"/login", payload, config)
+	if err != nil {
+		return "", err
+	}
+	defer zeroBytes(bodyBytes)
+
+	var loginResponse VaultLoginResponse
+	err = json.Unmarshal(bodyBytes, &loginResponse)
+	if err != nil {
+		return "", err
+	}
+
+	// Vault rejects an identity it can't verify with a 400.
+	if len(loginResponse.Errors) > 0 {
+		return "", &VaultAuthError{StatusCode: http.StatusBadRequest, Errors: loginResponse.Errors}
+	}
+
+	if len(loginResponse.Auth.ClientToken) == 0 {
+		return "", fmt.Errorf("vault server error: no token from logging in at auth/%s", mount)
+	}
+
+	RedactToken(loginResponse.Auth.ClientToken)
+	LogDebugf("Logged in to vault at auth/%s", mount)
+
+	return loginResponse.Auth.ClientToken, nil
+}
@@ -0,0 +1,141 @@
+package vaultexec
+
+// notify.go includes notifications of lifecycle events (e.g. the token failing
+// to renew, or the command exiting), sent to a webhook or a command so that
+// credential problems are noticed before the application falls over.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Lifecycle events.
+const (
+	EventRenewalFailure = "renewal_failure"
+	EventChildStart     = "child_start"
+	EventChildExit      = "child_exit"
+)
+
+// How long a notification can take before it is abandoned.
+const notifyTimeout = 10 * time.Second
+
+// Event is a lifecycle event, which is sent as JSON.
+type Event struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Message  string    `json:"message,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"` // For child_exit
+}
+
+// Notifier sends events to a webhook, a command, or both.
+type Notifier struct {
+	// The URL that events are POSTed to.
+	WebhookURL string
+
+	// The command line that is run for every event, with the event on stdin
+	// and its name in VAULTEXEC_EVENT.
+	Command string
+}
+
+var (
+	notifierMutex sync.Mutex
+	notifier      *Notifier
+)
+
+// SetNotifier sets where lifecycle events are sent, nil to not send them.
+func SetNotifier(n *Notifier) {
+	notifierMutex.Lock()
+	defer notifierMutex.Unlock()
+	notifier = n
+}
+
+// notify sends an event to the notifier, if there is one.  Failures are
+// logged rather than returned, since they shouldn't affect the command.
+func notify(event Event) {
+	notifierMutex.Lock()
+	n := notifier
+	notifierMutex.Unlock()
+
+	if n == nil {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	event.Message = Redact(event.Message)
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		LogErrorf("error encoding %s notification: %s", event.Event, err)
+		return
+	}
+
+	if len(n.WebhookURL) > 0 {
+		err = postNotification(n.WebhookURL, eventBytes)
+		if err != nil {
+			LogErrorf("error sending %s notification to webhook: %s", event.Event, err)
+		}
+	}
+
+	if len(n.Command) > 0 {
+		err = runNotificationCommand(n.Command, event.Event, eventBytes)
+		if err != nil {
+			LogErrorf("error running %s notification command: %s", event.Event, err)
+		}
+	}
+}
+
+func postNotification(url string, eventBytes []byte) error {
+	client := &http.Client{Timeout: notifyTimeout}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(eventBytes))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func runNotificationCommand(command string, event string, eventBytes []byte) error {
+	args, err := splitCommandLine(command)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(eventBytes)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "VAULTEXEC_EVENT="+event)
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(notifyTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("timed out after %s", notifyTimeout)
+	}
+}
@@ -0,0 +1,104 @@
+package vaultexec
+
+// probe.go includes an HTTP endpoint reporting the health of vaultexec and the
+// command it runs, for liveness and readiness probes (e.g. in kubernetes).
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HealthStatus is the body of a response from the health endpoint.
+type HealthStatus struct {
+	Healthy        bool       `json:"healthy"`
+	ChildRunning   bool       `json:"child_running"`
+	ChildStarted   *time.Time `json:"child_started,omitempty"`
+	StartupPolicy  string     `json:"startup_policy,omitempty"` // set if the command was started after the startup deadline
+	SecretsFetched *time.Time `json:"secrets_fetched,omitempty"`
+	TokenRenewal   string     `json:"token_renewal"` // ok, or the last renewal error
+	TokenExpires   *time.Time `json:"token_expires,omitempty"`
+}
+
+// healthStatus returns the current health: the command must be running, and
+// the token must not have failed to renew or expired.  A command started
+// without fetching the secrets (after the startup deadline) is still healthy,
+// since restarting it wouldn't help while vault is slow.
+func (m *vaultexecMetrics) healthStatus() HealthStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status := HealthStatus{
+		ChildRunning:  m.childRunning,
+		StartupPolicy: m.startupPolicy,
+		TokenRenewal:  "ok",
+	}
+
+	if m.childRunning {
+		started := m.childStarted
+		status.ChildStarted = &started
+	}
+	if !m.lastFetch.IsZero() {
+		fetched := m.lastFetch
+		status.SecretsFetched = &fetched
+	}
+	if !m.tokenExpiry.IsZero() {
+		expires := m.tokenExpiry
+		status.TokenExpires = &expires
+	}
+
+	renewalHealthy := true
+	if m.renewalError != nil {
+		status.TokenRenewal = Redact(m.renewalError.Error())
+		renewalHealthy = false
+	} else if status.TokenExpires != nil && time.Now().After(m.tokenExpiry) {
+		status.TokenRenewal = "token expired"
+		renewalHealthy = false
+	}
+
+	status.Healthy = m.childRunning && renewalHealthy
+
+	return status
+}
+
+// RecordStartupPolicy records that the command is being started by policy
+// (e.g. with cached secrets) because the startup deadline passed, which is
+// reported by the health check.
+func RecordStartupPolicy(policy string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.startupPolicy = policy
+}
+
+// ServeHealth serves the health of vaultexec as JSON at /health on addr (e.g.
+// :8080) in the background, returning an error if it can't listen there.  The
+// response status is 200 when healthy, and 503 otherwise.
+func ServeHealth(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error serving health: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		status := metrics.healthStatus()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			LogErrorf("error serving health: %s", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package vaultexec
+
+// prompt.go includes functions for getting a token from a developer running
+// vaultexec interactively: prompting for it on the terminal, and saving it
+// where the vault CLI's default token helper keeps it (~/.vault-token).
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+)
+
+// The file the vault CLI's default token helper stores the token in, relative
+// to the home directory.
+const vaultTokenFile = ".vault-token"
+
+func vaultTokenFilePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, vaultTokenFile), nil
+}
+
+// ReadVaultTokenFile returns the token saved in ~/.vault-token (e.g. by
+// "vault login"), or an empty string if there isn't one.
+func ReadVaultTokenFile() (string, error) {
+	path, err := vaultTokenFilePath()
+	if err != nil {
+		return "", nil
+	}
+
+	tokenBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("error reading vault token file: %s", err)
+	}
+
+	return strings.TrimSpace(string(tokenBytes)), nil
+}
+
+// SaveVaultTokenFile saves the token to ~/.vault-token, where it will be used
+// by vaultexec and the vault CLI when no other token is given.
+func SaveVaultTokenFile(token string) error {
+	path, err := vaultTokenFilePath()
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path, []byte(token), 0600)
+	if err != nil {
+		return fmt.Errorf("error saving vault token file: %s", err)
+	}
+
+	return nil
+}
+
+// PromptForVaultToken asks for the token on the terminal without echoing it.
+// If stdin isn't a terminal there is nobody to ask, so an empty token is
+// returned.
+func PromptForVaultToken() (string, error) {
+	if !isTerminal(os.Stdin) {
+		return "", nil
+	}
+
+	fmt.Fprint(os.Stderr, "Vault token: ")
+
+	err := setTerminalEcho(os.Stdin, false)
+	if err != nil {
+		return "", fmt.Errorf("error hiding the vault token prompt input: %s", err)
+	}
+
+	// Don't leave the terminal without echo if the prompt is interrupted.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+	go func() {
+		if _, ok := <-sigs; ok {
+			setTerminalEcho(os.Stdin, true)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(130)
+		}
+	}()
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	setTerminalEcho(os.Stdin, true)
+	fmt.Fprintln(os.Stderr)
+
+	if err != nil && len(line) == 0 {
+		return "", fmt.Errorf("error reading vault token: %s", err)
+	}
+
+	return strings.TrimSpace(line), nil
+}
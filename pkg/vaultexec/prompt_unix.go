@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package vaultexec
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setTerminalEcho turns echoing of typed input on the terminal on or off.
+func setTerminalEcho(f *os.File, enabled bool) error {
+	mode := "-echo"
+	if enabled {
+		mode = "echo"
+	}
+
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = f
+	return cmd.Run()
+}
+
+// isTerminal returns whether the file is an interactive terminal, rather than
+// e.g. a pipe or /dev/null.
+func isTerminal(f *os.File) bool {
+	fileInfo, err := f.Stat()
+	if err != nil || fileInfo.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	// Other character devices (like /dev/null) have no terminal settings.
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = f
+	return cmd.Run() == nil
+}
@@ -0,0 +1,38 @@
+package vaultexec
+
+import (
+	"os"
+	"syscall"
+)
+
+// ENABLE_ECHO_INPUT console mode flag.
+const enableEchoInput = 0x0004
+
+var setConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// setTerminalEcho turns echoing of typed input on the console on or off.
+func setTerminalEcho(f *os.File, enabled bool) error {
+	var mode uint32
+	err := syscall.GetConsoleMode(syscall.Handle(f.Fd()), &mode)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		mode |= enableEchoInput
+	} else {
+		mode &^= enableEchoInput
+	}
+
+	r, _, err := setConsoleMode.Call(f.Fd(), uintptr(mode))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// isTerminal returns whether the file is an interactive console.
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(syscall.Handle(f.Fd()), &mode) == nil
+}
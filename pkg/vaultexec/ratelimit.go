@@ -0,0 +1,93 @@
+package vaultexec
+
+// ratelimit.go includes a client-side rate limiter so that many instances of
+// vaultexec starting at once don't overwhelm the vault cluster.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket allowing rate requests per second on average,
+// with bursts of up to burst requests.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// newRateLimiter creates a rate limiter, or returns nil if rate is not
+// positive (which disables limiting).  A burst of zero defaults to the rate.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = int(rate)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a request is allowed to be made.
+func (limiter *rateLimiter) Wait() {
+	if limiter == nil {
+		return
+	}
+
+	limiter.mutex.Lock()
+
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.last = now
+
+	// Reserve a token, even if that puts us in debt, and wait for the debt to
+	// be paid off outside of the lock.
+	limiter.tokens--
+	var wait time.Duration
+	if limiter.tokens < 0 {
+		wait = time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	}
+
+	limiter.mutex.Unlock()
+
+	time.Sleep(wait)
+}
+
+// parseRateLimit parses a rate limit in the form "rate" or "rate:burst", as
+// used by the VAULT_RATE_LIMIT environment variable.
+func parseRateLimit(value string) (float64, int, error) {
+	parts := strings.SplitN(value, ":", 2)
+
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rate %q", parts[0])
+	}
+
+	burst := 0
+	if len(parts) == 2 {
+		burst, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid burst %q", parts[1])
+		}
+	}
+
+	return rate, burst, nil
+}
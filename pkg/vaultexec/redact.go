@@ -0,0 +1,88 @@
+package vaultexec
+
+// redact.go includes scrubbing tokens and secret values from everything that
+// vaultexec writes to stderr, since errors from HTTP requests, JSON parsing,
+// and commands can include them.
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// What redacted strings are replaced with.
+const redactedText = "[REDACTED]"
+
+// Values shorter than this aren't redacted, since they would match too much
+// of every message (e.g. a secret of "1").
+const minRedactedLength = 4
+
+// Vault tokens (service, batch, and recovery, with or without the hv prefix
+// of newer versions), which are redacted even if vaultexec never used them,
+// e.g. in the output of a generate-config command.
+var vaultTokenPattern = regexp.MustCompile(`\b(hv[sbr]|[sbr])\.[A-Za-z0-9_-]{20,}`)
+
+var (
+	redactMutex    sync.Mutex
+	redactedTokens = map[string]bool{}
+	redactedValues = map[string]bool{}
+)
+
+// RedactToken makes Redact scrub a token (or any other credential, e.g. a
+// secret ID) for as long as vaultexec runs.
+func RedactToken(token string) {
+	if len(token) < minRedactedLength {
+		return
+	}
+
+	redactMutex.Lock()
+	defer redactMutex.Unlock()
+	redactedTokens[token] = true
+}
+
+// redactSecretValues makes Redact scrub fetched secret values, until they are
+// forgotten by ForgetSecretValues.
+func redactSecretValues(values map[string]interface{}) {
+	redactMutex.Lock()
+	defer redactMutex.Unlock()
+
+	for _, v := range values {
+		if value := EnvValue(v); len(value) >= minRedactedLength {
+			redactedValues[value] = true
+		}
+	}
+}
+
+// forgetRedactedValues stops scrubbing secret values, so that they aren't kept
+// in memory once they are no longer needed.
+func forgetRedactedValues() {
+	redactMutex.Lock()
+	defer redactMutex.Unlock()
+	redactedValues = map[string]bool{}
+}
+
+// Redact replaces every token and secret value in s with [REDACTED].
+func Redact(s string) string {
+	redactMutex.Lock()
+	redacted := make([]string, 0, len(redactedTokens)+len(redactedValues))
+	for token := range redactedTokens {
+		redacted = append(redacted, token)
+	}
+	for value := range redactedValues {
+		redacted = append(redacted, value)
+	}
+	redactMutex.Unlock()
+
+	// Longer strings first, so that a value containing another is replaced
+	// whole.
+	sort.Slice(redacted, func(i, j int) bool {
+		return len(redacted[i]) > len(redacted[j])
+	})
+
+	for _, r := range redacted {
+		s = strings.Replace(s, r, redactedText, -1)
+	}
+
+	return vaultTokenPattern.ReplaceAllString(s, redactedText)
+}
@@ -0,0 +1,325 @@
+package vaultexec
+
+// reference.go includes the URI syntax for referencing secrets, which can be
+// used anywhere a secret path is given:
+//
+//     vault:///secret/my-app/all          A path on the configured vault server
+//     vault://vault.other:8200/secret/db  A path on another vault server
+//     file:///run/secrets/db.json         A file of secrets as a JSON object
+//     env://DB_PASSWORD                   An environment variable
+//     awssm://my-app/db                   A secret in AWS Secrets Manager
+//     consul://config/my-app              A key or prefix in Consul KV
+//     mybackend://my-app/db               A path in a registered SecretSource
+//
+// Any reference can end with #key to only use that key, e.g.
+// vault:///secret/my-app/all#DB_PASSWORD.  A file (or AWS secret, or consul
+// key) that isn't a JSON object is read as the single value of its key, e.g.
+// file:///run/secrets/db#DB_PASSWORD.
+// Paths that aren't references (no "://") are read from vault as they are.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretReference is a parsed secret path.
+type secretReference struct {
+	Source string // The name of the source to read from
+	Host   string // The vault server to use instead of the configured one
+	Path   string // The path within the source
+	Key    string // The only key to use, if set
+}
+
+// parseSecretReference parses a secret path, which is either a reference URI
+// or a plain vault path.
+func parseSecretReference(path string) (secretReference, error) {
+	parts := strings.SplitN(path, "://", 2)
+	if len(parts) != 2 {
+		return secretReference{Source: vaultSourceName, Path: path}, nil
+	}
+
+	ref := secretReference{Source: parts[0], Path: parts[1]}
+
+	if i := strings.LastIndex(ref.Path, "#"); i >= 0 {
+		ref.Key = ref.Path[i+1:]
+		ref.Path = ref.Path[:i]
+		if len(ref.Key) == 0 {
+			return ref, fmt.Errorf("invalid secret reference %s: empty key", path)
+		}
+	}
+
+	if ref.Source == vaultSourceName {
+		hostAndPath := strings.SplitN(ref.Path, "/", 2)
+		if len(hostAndPath) != 2 {
+			return ref, fmt.Errorf("invalid secret reference %s: must be vault://host/path or vault:///path", path)
+		}
+		ref.Host = hostAndPath[0]
+		ref.Path = hostAndPath[1]
+	}
+
+	if len(ref.Path) == 0 {
+		return ref, fmt.Errorf("invalid secret reference %s: empty path", path)
+	}
+
+	return ref, nil
+}
+
+// secretSourceForReference returns the source that a reference is read from.
+func secretSourceForReference(ref secretReference, config VaultConfig) (SecretSource, error) {
+	switch ref.Source {
+	case vaultSourceName:
+		if len(ref.Host) > 0 {
+			return newVaultHostSource(ref.Host, config)
+		}
+		return &vaultSource{config: config}, nil
+	case fileSourceName:
+		return &fileSource{key: ref.Key}, nil
+	case envSourceName:
+		return &envSource{}, nil
+	case awsSecretsManagerSourceName:
+		return &awsSecretsManagerSource{key: ref.Key}, nil
+	case consulSourceName:
+		return &consulSource{key: ref.Key}, nil
+	}
+
+	secretSourcesMutex.Lock()
+	source, ok := secretSources[ref.Source]
+	secretSourcesMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown secret source %s", ref.Source)
+	}
+
+	return source, nil
+}
+
+// fetchCache holds what was read from each path in a source during a single
+// fetch of every path, so that a path referenced more than once (e.g.
+// secret/my-app#A and secret/my-app#B) is only read once.
+type fetchCache struct {
+	mutex   sync.Mutex
+	fetches map[string]*cachedFetch
+}
+
+// cachedFetch is a read that has been started, which is complete once done is
+// closed.
+type cachedFetch struct {
+	done    chan struct{}
+	secrets map[string]interface{}
+	leaseID string
+	err     error
+}
+
+func newFetchCache() *fetchCache {
+	return &fetchCache{fetches: map[string]*cachedFetch{}}
+}
+
+// fetch returns the result of the read identified by key, calling read if it
+// hasn't been started yet, or waiting for it if it has.
+func (c *fetchCache) fetch(key string, read func() (map[string]interface{}, string, error)) (map[string]interface{}, string, error) {
+	c.mutex.Lock()
+	f, started := c.fetches[key]
+	if !started {
+		f = &cachedFetch{done: make(chan struct{})}
+		c.fetches[key] = f
+	}
+	c.mutex.Unlock()
+
+	if started {
+		<-f.done
+		LogDebugf("Reusing the secrets already read from %s", key)
+		return f.secrets, f.leaseID, f.err
+	}
+
+	f.secrets, f.leaseID, f.err = read()
+	close(f.done)
+
+	return f.secrets, f.leaseID, f.err
+}
+
+// fetchSecrets reads the secrets at path, which may be a reference to a
+// secret in any source.  If cache isn't nil, a path that has already been
+// read through it isn't read again.
+func fetchSecrets(path string, config VaultConfig, cache *fetchCache) (map[string]interface{}, string, error) {
+	ref, err := parseSecretReference(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	source, err := secretSourceForReference(ref, config)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	read := func() (map[string]interface{}, string, error) {
+		return source.Fetch(ref.Path)
+	}
+
+	var secrets map[string]interface{}
+	var leaseID string
+	if cache != nil {
+		// What's read from a file, AWS secret, or consul key depends on the
+		// key, see fileSource.
+		key := ref.Source + "://" + ref.Host + "/" + ref.Path
+		if ref.Source == fileSourceName || ref.Source == awsSecretsManagerSourceName || ref.Source == consulSourceName {
+			key += "#" + ref.Key
+		}
+		secrets, leaseID, err = cache.fetch(key, read)
+	} else {
+		secrets, leaseID, err = read()
+	}
+
+	if err != nil || len(ref.Key) == 0 {
+		return secrets, leaseID, err
+	}
+
+	// A reference to a single key must find it, even if the path has no
+	// secrets at all.
+	value, ok := secrets[ref.Key]
+	if !ok {
+		return nil, "", fmt.Errorf("key %s not found in %s", ref.Key, strings.TrimSuffix(path, "#"+ref.Key))
+	}
+
+	return map[string]interface{}{ref.Key: value}, leaseID, nil
+}
+
+// newVaultHostSource returns a vault source for a vault server other than the
+// configured one, which is connected to with the same options (including the
+// token) and the same scheme as the first configured address.  Since the token
+// is sent to it, the server must be one of the configured addresses or in
+// config.AllowedHosts.
+func newVaultHostSource(host string, config VaultConfig) (SecretSource, error) {
+	if !vaultHostAllowed(host, config) {
+		return nil, fmt.Errorf("vault server %s isn't the configured vault server, add it to -allow-vault-host to send it the token", host)
+	}
+
+	scheme := "https"
+	if addresses := splitVaultAddresses(config.Address); len(addresses) > 0 {
+		if address, err := url.Parse(addresses[0]); err == nil && len(address.Scheme) > 0 {
+			scheme = address.Scheme
+		}
+	}
+
+	config.Address = scheme + "://" + host
+	config.client = nil
+
+	config, err := WithVaultClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vaultSource{config: config}, nil
+}
+
+// vaultHostAllowed returns whether host (host:port) is the host of one of the
+// configured vault addresses, or one of config.AllowedHosts.
+func vaultHostAllowed(host string, config VaultConfig) bool {
+	for _, address := range splitVaultAddresses(config.Address) {
+		if u, err := url.Parse(address); err == nil && strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+
+	for _, allowed := range strings.Split(config.AllowedHosts, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseSecretsValue parses a JSON object of secrets, returning nil if value
+// isn't one.
+func parseSecretsValue(value []byte) map[string]interface{} {
+	var secrets map[string]interface{}
+	if json.Unmarshal(value, &secrets) != nil {
+		return nil
+	}
+	return secrets
+}
+
+// fileSource is the built in source for secrets in local files, e.g. mounted
+// by docker or kubernetes.
+type fileSource struct {
+	key string
+}
+
+func (s *fileSource) Fetch(path string) (map[string]interface{}, string, error) {
+	fileBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if secrets := parseSecretsValue(fileBytes); secrets != nil {
+		return secrets, "", nil
+	}
+
+	if len(s.key) == 0 {
+		return nil, "", fmt.Errorf("%s isn't a JSON object, so must be referenced with a #key to use as its name", path)
+	}
+
+	return map[string]interface{}{s.key: strings.TrimRight(string(fileBytes), "\r\n")}, "", nil
+}
+
+func (s *fileSource) Renew(increment time.Duration) (time.Duration, error) {
+	return 0, nil
+}
+
+// Watch polls the file's modification time every DefaultWatchInterval.
+func (s *fileSource) Watch(path string, stop <-chan struct{}) error {
+	initial, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(DefaultWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return ErrWatchStopped
+		case <-ticker.C:
+		}
+
+		current, err := os.Stat(path)
+		if err != nil || !current.ModTime().Equal(initial.ModTime()) || current.Size() != initial.Size() {
+			return nil
+		}
+	}
+}
+
+// envSource is the built in source for vaultexec's own environment variables.
+// A variable holding a JSON object provides its keys, otherwise the variable
+// is used as is.
+type envSource struct{}
+
+func (s *envSource) Fetch(name string) (map[string]interface{}, string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	if secrets := parseSecretsValue([]byte(value)); secrets != nil {
+		return secrets, "", nil
+	}
+
+	return map[string]interface{}{name: value}, "", nil
+}
+
+func (s *envSource) Renew(increment time.Duration) (time.Duration, error) {
+	return 0, nil
+}
+
+// Watch waits to be stopped, since the environment never changes.
+func (s *envSource) Watch(name string, stop <-chan struct{}) error {
+	<-stop
+	return ErrWatchStopped
+}
@@ -0,0 +1,162 @@
+package vaultexec
+
+// require.go includes assertions that the fetched secrets have every key that
+// the command expects, with values of the expected form, so that a missing
+// credential (or a placeholder like "CHANGEME") stops vaultexec with a clear
+// message rather than the command crashing later without it.
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RequiredKey is a key that must be in the fetched secrets, and optionally the
+// path it must be read from.
+type RequiredKey struct {
+	Key  string
+	Path string // Any path if empty
+}
+
+func (r RequiredKey) String() string {
+	if len(r.Path) == 0 {
+		return r.Key
+	}
+	return r.Path + "#" + r.Key
+}
+
+// ParseRequiredKeys parses a comma separated list of keys, e.g. "KEY1,KEY2",
+// or of keys that must be read from a path, e.g. "secret/my-app/db#KEY1,KEY2".
+func ParseRequiredKeys(s string) ([]RequiredKey, error) {
+	path, keys := "", s
+	if i := strings.LastIndex(s, "#"); i >= 0 {
+		path, keys = strings.TrimSpace(s[:i]), s[i+1:]
+		if len(path) == 0 {
+			return nil, fmt.Errorf("invalid required keys %q: empty path", s)
+		}
+	}
+
+	var required []RequiredKey
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if len(key) == 0 {
+			return nil, fmt.Errorf("invalid required keys %q: empty key", s)
+		}
+		required = append(required, RequiredKey{Key: key, Path: path})
+	}
+
+	return required, nil
+}
+
+// CheckRequiredKeys returns an error naming every required key that is missing
+// from the secrets, or that wasn't read from the path it's required from.
+func CheckRequiredKeys(secrets VaultSecrets, required []RequiredKey) error {
+	var missing []string
+
+	for _, r := range required {
+		if len(r.Path) == 0 {
+			if _, ok := secrets.Values[r.Key]; !ok {
+				missing = append(missing, r.String())
+			}
+			continue
+		}
+
+		found := false
+		for _, read := range secrets.Reads {
+			if read.Path == r.Path && containsString(read.Keys, r.Key) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r.String())
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required secret keys: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// The rules that a secret value can be checked against, other than regex.
+var valueRuleNames = []string{"non-empty", "numeric", "url"}
+
+// ValueRule is a rule that the value of a key must match.
+type ValueRule struct {
+	Key  string
+	Rule string // non-empty, numeric, url, or regex:<pattern>
+
+	pattern *regexp.Regexp
+}
+
+func (r ValueRule) String() string {
+	return r.Key + "=" + r.Rule
+}
+
+// ParseValueRule parses a rule in the form "KEY=rule", e.g. "DB_PORT=numeric"
+// or "API_KEY=regex:^[0-9a-f]{32}$".
+func ParseValueRule(s string) (ValueRule, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+		return ValueRule{}, fmt.Errorf("invalid value rule %q, must be in the form \"KEY=rule\"", s)
+	}
+
+	rule := ValueRule{Key: strings.TrimSpace(parts[0]), Rule: strings.TrimSpace(parts[1])}
+
+	if strings.HasPrefix(rule.Rule, "regex:") {
+		pattern, err := regexp.Compile(strings.TrimPrefix(rule.Rule, "regex:"))
+		if err != nil {
+			return ValueRule{}, fmt.Errorf("invalid value rule %q: %s", s, err)
+		}
+		rule.pattern = pattern
+	} else if !containsString(valueRuleNames, rule.Rule) {
+		return ValueRule{}, fmt.Errorf("invalid value rule %q, must be one of: %s, or regex:<pattern>", s, strings.Join(valueRuleNames, ", "))
+	}
+
+	return rule, nil
+}
+
+// matches returns whether a value matches the rule.
+func (r ValueRule) matches(value string) bool {
+	if r.pattern != nil {
+		return r.pattern.MatchString(value)
+	}
+
+	switch r.Rule {
+	case "non-empty":
+		return len(strings.TrimSpace(value)) > 0
+	case "numeric":
+		_, err := strconv.ParseFloat(value, 64)
+		return err == nil
+	case "url":
+		u, err := url.Parse(value)
+		return err == nil && len(u.Scheme) > 0 && len(u.Host) > 0
+	}
+
+	return false
+}
+
+// CheckValueRules returns an error naming every key whose value doesn't match
+// its rules (never the value itself).  Keys that weren't fetched are skipped,
+// see CheckRequiredKeys.
+func CheckValueRules(secrets VaultSecrets, rules []ValueRule) error {
+	var invalid []string
+
+	for _, rule := range rules {
+		v, ok := secrets.Values[rule.Key]
+		if !ok || rule.matches(EnvValue(v)) {
+			continue
+		}
+		invalid = append(invalid, fmt.Sprintf("%s (from %s) must match %s", rule.Key, secrets.Sources[rule.Key], rule.Rule))
+	}
+
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid secret values: %s", strings.Join(invalid, ", "))
+	}
+
+	return nil
+}
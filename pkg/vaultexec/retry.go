@@ -0,0 +1,111 @@
+package vaultexec
+
+// retry.go includes the policy for retrying requests to vault that fail with
+// transient errors.
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for retrying requests, similar to go-retryablehttp.
+const (
+	DefaultMaxRetries   = 2
+	DefaultRetryWaitMin = 1 * time.Second
+	DefaultRetryWaitMax = 30 * time.Second
+)
+
+// isIdempotentMethod returns whether a request with the given method can be
+// safely sent more than once.
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS", "LIST":
+		return true
+	}
+	return false
+}
+
+// shouldRetryVaultRequest determines whether a request failed in a way that is
+// likely to succeed if tried again: connection errors, rate limiting, reads
+// from a standby that hasn't caught up yet, and server errors (other than "not
+// implemented").
+func shouldRetryVaultRequest(resp *vaultResponse, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusPreconditionFailed {
+		return true
+	}
+
+	return resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented
+}
+
+// vaultUnavailableReason returns why vault answered that it can't handle any
+// requests (HTTP 503, e.g. "Vault is sealed"), or an empty string if it
+// didn't.
+func vaultUnavailableReason(resp *vaultResponse, err error) string {
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		return ""
+	}
+
+	var errorResponse VaultRevokeResponse
+	if json.Unmarshal(resp.Body, &errorResponse) == nil && len(errorResponse.Errors) > 0 {
+		return strings.Join(errorResponse.Errors, ",")
+	}
+
+	return "HTTP status 503"
+}
+
+// retryBackoff returns how long to wait before the next attempt.  The server's
+// Retry-After header is honored if present, otherwise the wait grows
+// exponentially from RetryWaitMin up to RetryWaitMax with some jitter so that
+// many clients don't retry in lockstep.
+func retryBackoff(attempt int, resp *vaultResponse, config VaultConfig) time.Duration {
+	if resp != nil {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return retryAfter
+		}
+	}
+
+	wait := config.RetryWaitMin << uint(attempt)
+	if wait <= 0 || wait > config.RetryWaitMax {
+		wait = config.RetryWaitMax
+	}
+
+	// Add up to 50% jitter, without exceeding the maximum wait.
+	if jitter := int64(wait / 2); jitter > 0 {
+		wait += time.Duration(rand.Int63n(jitter))
+	}
+	if wait > config.RetryWaitMax {
+		wait = config.RetryWaitMax
+	}
+
+	return wait
+}
+
+// parseRetryAfter parses a Retry-After header, which can either be a number of
+// seconds or an HTTP date.
+func parseRetryAfter(retryAfter string) (time.Duration, bool) {
+	if len(retryAfter) == 0 {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
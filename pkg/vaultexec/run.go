@@ -0,0 +1,153 @@
+package vaultexec
+
+// run.go includes functions for running processes with provided environment
+// variables.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// PrintSecretSources writes the name of every environment variable that would
+// be set from the secrets, along with the path it was read from.  Values are
+// never printed.
+func PrintSecretSources(w io.Writer, secrets VaultSecrets) {
+	keys := make([]string, 0, len(secrets.Values))
+	for k := range secrets.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s (from %s)\n", k, secrets.Sources[k])
+	}
+}
+
+// EnvValue formats a secret value for use as an environment variable.  Values
+// that aren't strings (numbers, booleans, objects) are formatted as JSON.
+func EnvValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(valueBytes)
+}
+
+// CommandError is returned by RunWithEnvVars when the command couldn't be
+// started or exited unsuccessfully, so that it can be told apart from
+// vaultexec's own errors (e.g. running a generate-config command).
+type CommandError struct {
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+// RunWithEnvVars runs command with the provided environment variables and returns
+// a channel for when the error processes.  Once the command has started the
+// values are removed from envVars (see ForgetSecretValues), so that vaultexec
+// doesn't keep the secrets in memory for as long as the command runs.
+func RunWithEnvVars(command []string, envVars map[string]interface{}) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Add the environment variables to the command.
+	env := os.Environ()
+	for k, v := range envVars {
+		env = append(env, fmt.Sprintf("%s=%s", k, EnvValue(v)))
+	}
+	cmd.Env = env
+
+	// Trap signals before the command starts, so that none arrive before
+	// they are forwarded to it.
+	sigs := make(chan os.Signal, 1)
+
+	signal.Notify(
+		sigs,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT,
+	)
+
+	err := cmd.Start()
+	if err != nil {
+		signal.Stop(sigs)
+		return &CommandError{err}
+	}
+
+	// Send any trapped signals to the process, if we fail to pass it on, then
+	// return the error to the channel so that the process can quit.
+	go func() {
+		LogInfof("Waiting for Signals")
+		for sig := range sigs {
+			LogInfof("Received Signal: %s", sig)
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				sdNotify("STOPPING=1")
+			}
+			err := cmd.Process.Signal(sig)
+			if err != nil {
+				LogErrorf("error sending signal to process: %s", err)
+			}
+		}
+	}()
+
+	metrics.recordChild(true)
+	defer metrics.recordChild(false)
+
+	// A slow webhook or command mustn't hold up the command.
+	startNotified := make(chan struct{})
+	go func() {
+		defer close(startNotified)
+		notify(Event{Event: EventChildStart, Message: QuoteCommandLine(command)})
+	}()
+
+	sdNotify("READY=1")
+
+	watchdogStop := make(chan struct{})
+	defer close(watchdogStop)
+	go keepSystemdWatchdog(watchdogStop)
+
+	// The command has its own copy of the secrets now.
+	cmd.Env = nil
+	ForgetSecretValues(envVars)
+
+	// Stop trapping signals before the channel is closed, since signals are
+	// still sent once the command has exited (e.g. while leases are revoked).
+	defer func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}()
+
+	err = cmd.Wait()
+
+	sdNotify("STOPPING=1")
+
+	exitCode := cmd.ProcessState.ExitCode()
+	metrics.recordChildExit(exitCode)
+	event := Event{Event: EventChildExit, ExitCode: &exitCode}
+	if err != nil {
+		event.Message = err.Error()
+	}
+
+	// The exit is notified after the start, and before vaultexec exits.
+	<-startNotified
+	notify(event)
+
+	if err != nil {
+		return &CommandError{err}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package vaultexec
+
+// sdnotify.go includes notifying systemd of vaultexec's state when it's run as
+// a Type=notify service, and pinging systemd's watchdog (WatchdogSec) for as
+// long as vaultexec and the command are healthy (see probe.go).
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state (e.g. READY=1) to systemd, if vaultexec was started
+// by systemd with a NOTIFY_SOCKET.  Failures are logged, since they shouldn't
+// affect the command.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return
+	}
+
+	// A leading @ (an abstract socket) is handled by the net package.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		LogErrorf("error notifying systemd of %s: %s", state, err)
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		LogErrorf("error notifying systemd of %s: %s", state, err)
+		return
+	}
+
+	LogDebugf("Notified systemd of %s", state)
+}
+
+// keepSystemdWatchdog pings systemd's watchdog twice every WATCHDOG_USEC, but
+// only while healthy, so that systemd restarts the service if the command or
+// token renewal is stuck.  It returns once stop is closed, or straight away if
+// the watchdog isn't enabled for vaultexec.
+func keepSystemdWatchdog(stop <-chan struct{}) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if metrics.healthStatus().Healthy {
+			sdNotify("WATCHDOG=1")
+		} else {
+			LogWarnf("Not pinging the systemd watchdog, since vaultexec isn't healthy")
+		}
+	}
+}
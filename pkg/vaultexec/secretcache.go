@@ -0,0 +1,220 @@
+package vaultexec
+
+// secretcache.go includes an encrypted cache of the last secrets that were
+// fetched successfully, which can be used to start the command when vault is
+// briefly unreachable (e.g. during an outage of an edge node's vault), rather
+// than every restart failing.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SecretCacheOptions configures the secret cache.
+type SecretCacheOptions struct {
+	File    string // Where the encrypted secrets are cached
+	KeyFile string // A hex encoded 256 bit AES key, e.g. from openssl rand -hex 32
+
+	// How old the cached secrets can be and still be used when they can't be
+	// fetched, 0 to never use them.
+	AllowStale time.Duration
+}
+
+// secretCache is the format of the cache once decrypted.  The vault address,
+// paths, and key naming are stored so that changing them invalidates the
+// cache.  Lease IDs aren't cached, since the leases are likely to have expired
+// by the time the cache is used.
+type secretCache struct {
+	Address   string                 `json:"address"`
+	Path      string                 `json:"path"`
+	PathDelim string                 `json:"path_delim"`
+	KeyNaming KeyNaming              `json:"key_naming"`
+	FetchedAt time.Time              `json:"fetched_at"`
+	Values    map[string]interface{} `json:"values"`
+	Sources   map[string]string      `json:"sources"`
+	Keys      map[string]string      `json:"keys"`
+	Reads     []SecretRead           `json:"reads"`
+}
+
+// GetVaultSecretsWithCache fetches the secrets like GetVaultSecrets, caching
+// them if they are fetched.  If they can't be fetched for any reason other
+// than vault rejecting the token, cached secrets that are no older than
+// options.AllowStale are returned instead.
+func GetVaultSecretsWithCache(config VaultConfig, options SecretCacheOptions) (VaultSecrets, error) {
+	secrets, err := GetVaultSecrets(config)
+
+	if err == nil {
+		cacheErr := writeSecretCache(options, config, secrets)
+		if cacheErr != nil {
+			LogErrorf("error caching secrets: %s", cacheErr)
+		}
+		return secrets, nil
+	}
+
+	if _, ok := err.(*VaultAuthError); ok || options.AllowStale <= 0 {
+		return secrets, err
+	}
+
+	cached, fetchedAt, cacheErr := GetCachedVaultSecrets(config, options)
+	if cacheErr != nil {
+		LogWarnf("Unable to use cached secrets: %s", cacheErr)
+		return secrets, err
+	}
+
+	LogWarnf("Using secrets cached %s ago, since they can't be fetched: %s", time.Since(fetchedAt).Round(time.Second), err)
+
+	return cached, nil
+}
+
+// GetCachedVaultSecrets returns the cached secrets and when they were fetched,
+// if they were cached from the same vault and paths and are no older than
+// options.AllowStale.
+func GetCachedVaultSecrets(config VaultConfig, options SecretCacheOptions) (VaultSecrets, time.Time, error) {
+	cached, err := readSecretCache(options, config)
+	if err != nil {
+		return VaultSecrets{}, time.Time{}, err
+	}
+
+	age := time.Since(cached.FetchedAt)
+	if age > options.AllowStale {
+		return VaultSecrets{}, time.Time{}, fmt.Errorf("the secrets were cached %s ago (more than %s)", age.Round(time.Second), options.AllowStale)
+	}
+
+	redactSecretValues(cached.Values)
+
+	return VaultSecrets{
+		Values:     cached.Values,
+		Sources:    cached.Sources,
+		SourceKeys: cached.Keys,
+		Reads:      cached.Reads,
+	}, cached.FetchedAt, nil
+}
+
+// readSecretCacheKey reads the key that the cache is encrypted with.
+func readSecretCacheKey(keyFile string) (cipher.AEAD, error) {
+	keyBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading secret cache key: %s", err)
+	}
+	defer zeroBytes(keyBytes)
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(keyBytes)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("secret cache key must be 32 hex encoded bytes, e.g. from openssl rand -hex 32")
+	}
+	defer zeroBytes(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// readSecretCache decrypts the cached secrets, which must have been fetched
+// from the same vault and paths.
+func readSecretCache(options SecretCacheOptions, config VaultConfig) (secretCache, error) {
+	var cache secretCache
+
+	gcm, err := readSecretCacheKey(options.KeyFile)
+	if err != nil {
+		return cache, err
+	}
+
+	encrypted, err := ioutil.ReadFile(options.File)
+	if err != nil {
+		return cache, err
+	}
+
+	if len(encrypted) < gcm.NonceSize() {
+		return cache, fmt.Errorf("%s is not a secret cache", options.File)
+	}
+
+	cacheBytes, err := gcm.Open(nil, encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():], nil)
+	if err != nil {
+		return cache, fmt.Errorf("error decrypting %s, it may have been encrypted with another key", options.File)
+	}
+	defer zeroBytes(cacheBytes)
+
+	err = json.Unmarshal(cacheBytes, &cache)
+	if err != nil {
+		return cache, err
+	}
+
+	if cache.Address != config.Address {
+		return cache, fmt.Errorf("%s was cached from a different vault address", options.File)
+	}
+
+	if cache.Path != config.Path || cache.PathDelim != config.PathDelim {
+		return cache, fmt.Errorf("%s was cached for different paths", options.File)
+	}
+
+	if cache.KeyNaming != config.KeyNaming {
+		return cache, fmt.Errorf("%s was cached with different key naming", options.File)
+	}
+
+	return cache, nil
+}
+
+// writeSecretCache encrypts and stores the secrets.  Like the generate-config
+// cache, the file is only readable by the current user, and is replaced
+// atomically so that concurrent invocations never read a partial file.
+func writeSecretCache(options SecretCacheOptions, config VaultConfig, secrets VaultSecrets) error {
+	gcm, err := readSecretCacheKey(options.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	cacheBytes, err := json.Marshal(secretCache{
+		Address:   config.Address,
+		Path:      config.Path,
+		PathDelim: config.PathDelim,
+		KeyNaming: config.KeyNaming,
+		FetchedAt: time.Now(),
+		Values:    secrets.Values,
+		Sources:   secrets.Sources,
+		Keys:      secrets.SourceKeys,
+		Reads:     secrets.Reads,
+	})
+	if err != nil {
+		return err
+	}
+	defer zeroBytes(cacheBytes)
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+
+	encrypted := gcm.Seal(nonce, nonce, cacheBytes, nil)
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(options.File), filepath.Base(options.File)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	// TempFile creates the file with 0600 permissions.
+	_, err = tempFile.Write(encrypted)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), options.File)
+}
@@ -0,0 +1,96 @@
+package vaultexec
+
+// shell.go includes functions for splitting and quoting command lines.
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// splitCommandLine splits a command line into its arguments, honoring single
+// quotes, double quotes, and backslash escapes the way a POSIX shell would
+// (without any expansion).
+func splitCommandLine(commandLine string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, c := range commandLine {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.New("command line ends with an unfinished escape")
+	}
+	if quote != 0 {
+		return nil, errors.New("command line has an unterminated quote")
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// QuoteCommandLine joins arguments into a command line that a POSIX shell
+// would split back into the same arguments.
+func QuoteCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+
+	for i, arg := range args {
+		if len(arg) > 0 && strings.IndexFunc(arg, func(c rune) bool {
+			return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./=:,@%+", c))
+		}) < 0 {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// shellCommand creates a command that runs the command line with the system
+// shell.
+func shellCommand(commandLine string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", commandLine)
+	}
+	return exec.Command("sh", "-c", commandLine)
+}
@@ -0,0 +1,126 @@
+package vaultexec
+
+// source.go includes the SecretSource interface, which lets secrets be read
+// from backends other than vault, and the registry of sources.  A path is read
+// from a registered source by referencing it with the source's name, e.g.
+// "mybackend://app/db" (see reference.go), while paths that aren't references
+// are read from vault.
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// SecretSource is a backend that secrets can be read from.
+type SecretSource interface {
+	// Fetch returns the secrets at path (nil if there are none), along with a
+	// lease ID if they are leased.
+	Fetch(path string) (map[string]interface{}, string, error)
+
+	// Renew renews the source's credentials, requesting increment if it's
+	// non-zero, and returns how long they are now valid for.
+	Renew(increment time.Duration) (time.Duration, error)
+
+	// Watch blocks until the secrets at path may have changed, returning nil,
+	// or until stop is closed, returning ErrWatchStopped.
+	Watch(path string, stop <-chan struct{}) error
+}
+
+// ErrWatchStopped is returned by SecretSource.Watch when it is stopped.
+var ErrWatchStopped = errors.New("watch stopped")
+
+// The names of the built in sources, which can't be replaced.
+const (
+	vaultSourceName             = "vault"
+	fileSourceName              = "file"
+	envSourceName               = "env"
+	awsSecretsManagerSourceName = "awssm"
+	consulSourceName            = "consul"
+)
+
+// DefaultWatchInterval is how often vault is polled when watching a path.
+const DefaultWatchInterval = time.Minute
+
+var secretSourceNamePattern = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
+var (
+	secretSourcesMutex sync.Mutex
+	secretSources      = map[string]SecretSource{}
+)
+
+// RegisterSecretSource makes a source available for paths prefixed with
+// "name://".  Names are lower case, and each can only be registered once.
+func RegisterSecretSource(name string, source SecretSource) error {
+	if !secretSourceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid secret source name %q, must be lower case letters, digits, +, -, or .", name)
+	}
+	switch name {
+	case vaultSourceName, fileSourceName, envSourceName, awsSecretsManagerSourceName, consulSourceName:
+		return fmt.Errorf("secret source %s is built in", name)
+	}
+
+	secretSourcesMutex.Lock()
+	defer secretSourcesMutex.Unlock()
+
+	if _, ok := secretSources[name]; ok {
+		return fmt.Errorf("secret source %s is already registered", name)
+	}
+	secretSources[name] = source
+
+	return nil
+}
+
+// vaultSource is the built in source, which reads secrets from vault.
+type vaultSource struct {
+	config VaultConfig
+}
+
+func (s *vaultSource) Fetch(path string) (map[string]interface{}, string, error) {
+	return GetVaultSecretsAtPath(path, s.config)
+}
+
+func (s *vaultSource) Renew(increment time.Duration) (time.Duration, error) {
+	leaseDuration, err := RenewVaultToken(s.config, increment)
+	return time.Duration(leaseDuration) * time.Second, err
+}
+
+// Watch polls vault every DefaultWatchInterval, as vault has no way to be
+// notified of changes.
+func (s *vaultSource) Watch(path string, stop <-chan struct{}) error {
+	initial, _, err := s.Fetch(path)
+	if err != nil {
+		return err
+	}
+
+	return pollUntilChanged(stop, func() (bool, error) {
+		current, _, err := s.Fetch(path)
+		return !reflect.DeepEqual(initial, current), err
+	})
+}
+
+// pollUntilChanged calls changed every DefaultWatchInterval until it reports a
+// change (returning nil) or an error, or until stop is closed.
+func pollUntilChanged(stop <-chan struct{}, changed func() (bool, error)) error {
+	ticker := time.NewTicker(DefaultWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return ErrWatchStopped
+		case <-ticker.C:
+		}
+
+		c, err := changed()
+		if err != nil {
+			return err
+		}
+		if c {
+			return nil
+		}
+	}
+}
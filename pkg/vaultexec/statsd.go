@@ -0,0 +1,72 @@
+package vaultexec
+
+// statsd.go includes sending the metrics (see metrics.go) to statsd or
+// DogStatsD as they are recorded, for jobs that don't live long enough to be
+// scraped by Prometheus.
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// statsdClient sends metrics over UDP, which never blocks on or fails because
+// of the statsd server.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   string // DogStatsD tags, e.g. "|#env:prod,team:web"
+}
+
+var (
+	statsdMutex sync.Mutex
+	statsd      *statsdClient
+)
+
+// SetStatsd sends metrics to the statsd server at addr (e.g. 127.0.0.1:8125),
+// with names starting with prefix (e.g. "vaultexec.").  Tags (e.g.
+// "env:prod") are sent in the DogStatsD format, so should only be used with a
+// server that supports it.  An empty addr stops sending metrics.
+func SetStatsd(addr string, prefix string, tags []string) error {
+	statsdMutex.Lock()
+	defer statsdMutex.Unlock()
+
+	if statsd != nil {
+		statsd.conn.Close()
+		statsd = nil
+	}
+
+	if len(addr) == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to statsd: %s", err)
+	}
+
+	statsd = &statsdClient{conn: conn, prefix: prefix}
+	if len(tags) > 0 {
+		statsd.tags = "|#" + strings.Join(tags, ",")
+	}
+
+	return nil
+}
+
+// sendStatsd sends a metric of the given statsd type (c, g, or ms), if statsd
+// is configured.  Errors are only logged at debug level, since metrics are
+// best effort.
+func sendStatsd(name string, value float64, metricType string) {
+	statsdMutex.Lock()
+	defer statsdMutex.Unlock()
+
+	if statsd == nil {
+		return
+	}
+
+	_, err := fmt.Fprintf(statsd.conn, "%s%s:%g|%s%s", statsd.prefix, name, value, metricType, statsd.tags)
+	if err != nil {
+		LogDebugf("Error sending %s to statsd: %s", name, err)
+	}
+}
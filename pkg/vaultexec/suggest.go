@@ -0,0 +1,51 @@
+package vaultexec
+
+// suggest.go includes a helper for suggesting the option or field that was
+// probably meant when an unknown one (e.g. a typo like "adress") is given.
+
+// ClosestName returns the candidate that name is most likely a misspelling
+// of, or an empty string if none of them are close.
+func ClosestName(name string, candidates []string) string {
+	closest := ""
+	closestDistance := len(name)/3 + 1
+
+	for _, candidate := range candidates {
+		distance := editDistance(name, candidate)
+		if distance <= closestDistance && (len(closest) == 0 || distance < editDistance(name, closest)) {
+			closest = candidate
+		}
+	}
+
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
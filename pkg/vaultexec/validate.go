@@ -0,0 +1,160 @@
+package vaultexec
+
+// validate.go includes functions for checking the full configuration of
+// vaultexec before a deploy: that vault is reachable, the token works and can
+// read every path, and that every path has secrets.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// hasReadCapability returns whether the capabilities allow reading a path.
+func hasReadCapability(capabilities []string) bool {
+	for _, capability := range capabilities {
+		if capability == "deny" {
+			return false
+		}
+	}
+	for _, capability := range capabilities {
+		if capability == "read" || capability == "root" {
+			return true
+		}
+	}
+	return false
+}
+
+// vaultCapabilityPaths returns the vault path of each of paths that is read
+// from the configured vault server, since capabilities only apply to those,
+// along with the list of vault paths to check.
+func vaultCapabilityPaths(paths []string) (map[string]string, []string) {
+	vaultPaths := map[string]string{}
+	var capabilityPaths []string
+	for _, path := range paths {
+		ref, err := parseSecretReference(path)
+		if err == nil && ref.Source == vaultSourceName && len(ref.Host) == 0 {
+			vaultPaths[path] = ref.Path
+			if !containsString(capabilityPaths, ref.Path) {
+				capabilityPaths = append(capabilityPaths, ref.Path)
+			}
+		}
+	}
+	return vaultPaths, capabilityPaths
+}
+
+// CapabilityError is returned by CheckVaultCapabilities when the token can't
+// read some of the paths, as opposed to the check itself failing.
+type CapabilityError struct {
+	Problems []string // e.g. "token lacks read on secret/app/db (has: deny)"
+}
+
+func (e *CapabilityError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// CheckVaultCapabilities checks that the token can read every configured path
+// before any are fetched, returning a *CapabilityError naming each path it
+// can't read.  The token must be able to use sys/capabilities-self, otherwise
+// a *VaultAuthError is returned.
+func CheckVaultCapabilities(config VaultConfig) error {
+	paths := strings.Split(config.Path, config.PathDelim)
+
+	vaultPaths, capabilityPaths := vaultCapabilityPaths(paths)
+	if len(capabilityPaths) == 0 {
+		return nil
+	}
+
+	capabilities, err := GetVaultTokenCapabilities(capabilityPaths, config)
+	if _, ok := err.(*VaultAuthError); ok {
+		// The token is invalid, or may lack access to sys/capabilities-self.
+		return err
+	} else if err != nil {
+		return fmt.Errorf("error checking token capabilities: %s", err)
+	}
+
+	var problems []string
+	for _, path := range paths {
+		vaultPath, ok := vaultPaths[path]
+		if ok && !hasReadCapability(capabilities[vaultPath]) {
+			problems = append(problems, fmt.Sprintf("token lacks read on %s (has: %s)",
+				path, strings.Join(capabilities[vaultPath], ",")))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &CapabilityError{Problems: problems}
+	}
+
+	return nil
+}
+
+// The kinds of problem that ValidateVaultSetup finds.
+const (
+	ConfigProblem = "config" // The configuration is wrong, e.g. a path has no secrets
+	AuthProblem   = "auth"   // The token is invalid, or can't read a path
+	FetchProblem  = "fetch"  // Vault can't be reached, or a path can't be read
+)
+
+// ValidationProblem is a problem found by ValidateVaultSetup.
+type ValidationProblem struct {
+	Kind    string
+	Message string
+}
+
+// ValidateVaultSetup checks everything needed to fetch secrets with the given
+// config, returning every problem found.  The config must have already passed
+// ValidateVaultConfig.
+func ValidateVaultSetup(config VaultConfig) []ValidationProblem {
+	var problems []ValidationProblem
+
+	health, err := GetVaultHealth(config)
+	if err != nil {
+		// Nothing else can be checked if the server can't be reached.
+		return append(problems, ValidationProblem{FetchProblem, fmt.Sprintf(
+			"vault at %s is unreachable (%s) - check the address and network access", config.Address, err)})
+	}
+	if reason := vaultNotReadyReason(health, false); len(reason) > 0 {
+		return append(problems, ValidationProblem{FetchProblem, fmt.Sprintf(
+			"vault at %s is %s - it must be initialized and unsealed", config.Address, reason)})
+	}
+
+	_, err = GetVaultTokenRenewable(config)
+	if err != nil {
+		// Without a working token the remaining checks would all fail too.
+		return append(problems, ValidationProblem{AuthProblem, fmt.Sprintf(
+			"token authentication failed (%s) - check that the token is valid and not expired", err)})
+	}
+
+	paths := strings.Split(config.Path, config.PathDelim)
+
+	vaultPaths, capabilityPaths := vaultCapabilityPaths(paths)
+
+	var capabilities map[string][]string
+	if len(capabilityPaths) > 0 {
+		capabilities, err = GetVaultTokenCapabilities(capabilityPaths, config)
+		if err != nil {
+			problems = append(problems, ValidationProblem{AuthProblem, fmt.Sprintf(
+				"unable to check token capabilities (%s) - the token may lack access to sys/capabilities-self", err)})
+		}
+	}
+
+	for _, path := range paths {
+		vaultPath, ok := vaultPaths[path]
+		if ok && capabilities != nil && !hasReadCapability(capabilities[vaultPath]) {
+			problems = append(problems, ValidationProblem{AuthProblem, fmt.Sprintf(
+				"token lacks read on %s (has: %s) - grant read in one of the token's policies",
+				path, strings.Join(capabilities[vaultPath], ","))})
+			continue
+		}
+
+		secrets, _, err := fetchSecrets(path, config, nil)
+		if err != nil {
+			problems = append(problems, ValidationProblem{FetchProblem, fmt.Sprintf("unable to read %s (%s)", path, err)})
+		} else if secrets == nil {
+			problems = append(problems, ValidationProblem{ConfigProblem, fmt.Sprintf(
+				"no secrets found at %s - check the path and that secrets have been written to it", path)})
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,1238 @@
+package vaultexec
+
+// vault.go provides the mechanisms and configurations to fetch secrets from vault.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultConfig is a set of values for reading secrets from a Vault server over HTTP.
+type VaultConfig struct {
+	Address   string `json:"address"` // e.g. https://path.to.vault:8200, comma separated for failover
+	Token     string `json:"token"`
+	Path      string `json:"path"`       // The path to the secrets to dump.
+	PathDelim string `json:"path-delim"` // Delimeter for multiple paths
+
+	// TLS configuration for talking to the vault server.
+	CACert        string `json:"ca-cert"`     // PEM encoded CA certificate file
+	CAPath        string `json:"ca-path"`     // Directory of PEM encoded CA certificates
+	ClientCert    string `json:"client-cert"` // PEM encoded client certificate file
+	ClientKey     string `json:"client-key"`  // PEM encoded client key file
+	TLSSkipVerify bool   `json:"tls-skip-verify"`
+	TLSServerName string `json:"tls-server-name"` // SNI host name
+
+	// Proxy to send requests through, overriding HTTP_PROXY/HTTPS_PROXY.
+	Proxy string `json:"proxy"` // e.g. http://proxy.host:3128
+
+	// Additional headers sent with every request, e.g. for an authenticating
+	// proxy in front of vault.
+	Headers http.Header `json:"-"`
+
+	// Timeouts for the whole request and for establishing a connection.
+	RequestTimeout time.Duration `json:"-"`
+	DialTimeout    time.Duration `json:"-"`
+
+	// Retry behavior for transient errors.
+	MaxRetries   int           `json:"-"`
+	RetryWaitMin time.Duration `json:"-"`
+	RetryWaitMax time.Duration `json:"-"`
+
+	// How long to keep retrying while vault is sealed or has no active node
+	// (HTTP 503), 0 to only retry MaxRetries times.
+	UnavailableTimeout time.Duration `json:"-"`
+
+	// Client-side rate limiting of requests, a rate of 0 disables limiting.
+	RateLimit      float64 `json:"-"` // Requests per second
+	RateLimitBurst int     `json:"-"`
+
+	// Read-after-write consistency with performance standbys and replication
+	// (Vault Enterprise), see consistency.go.
+	RequireConsistency bool   `json:"-"`
+	VaultIndex         string `json:"-"` // Initial X-Vault-Index state
+	InconsistentRead   string `json:"-"` // Sent as X-Vault-Inconsistent
+
+	// How many paths are fetched at once, 0 or 1 to fetch them one at a time.
+	FetchConcurrency int `json:"-"`
+
+	// How long to wait for a read that needs control group approval to be
+	// authorized (Vault Enterprise), 0 to fail right away.
+	ControlGroupTimeout time.Duration `json:"-"`
+
+	// How the keys of the secrets are named, see keynaming.go.
+	KeyNaming KeyNaming `json:"-"`
+
+	// Other vault servers (host:port, comma separated) that vault://host/path
+	// references can read from with the token, besides the configured ones.
+	AllowedHosts string `json:"-"`
+
+	// The client shared by every request made with this config, see
+	// WithVaultClient.
+	client *vaultClient
+}
+
+// vaultClient holds the connection state that is reused across requests.
+type vaultClient struct {
+	httpClient *http.Client
+
+	// Every vault server address we can fail over between, and the index of
+	// the one that most recently answered successfully.
+	addresses      []string
+	healthyAddress int
+	mutex          sync.Mutex
+
+	limiter *rateLimiter
+
+	// The most recent X-Vault-Index state, see consistency.go.
+	vaultIndex string
+}
+
+// The most redirects (e.g. from a standby to the active node) that will be
+// followed for a single request.
+const maxVaultRedirects = 5
+
+// Default timeouts for requests to vault, a zero value disables the timeout.
+const (
+	DefaultRequestTimeout = 60 * time.Second
+	DefaultDialTimeout    = 10 * time.Second
+)
+
+// DefaultFetchConcurrency is how many paths are fetched at once by default.
+const DefaultFetchConcurrency = 4
+
+// VaultSecretResponse is a partial representation of the reponse that comes
+// back when fetching secrets.
+type VaultSecretResponse struct {
+	Errors []string `json:"errors"`
+	// The data that comes back for secrets can be of any type, but the keys will
+	// always be strings.  So rather than have map[string]string, which fails to
+	// unmarshal, we just use map[string]interface{}
+	Data map[string]interface{} `json:"data"`
+	// Dynamic secrets (database credentials, cloud keys, etc.) come back with a
+	// lease that can be revoked once we're done with them.
+	LeaseID string `json:"lease_id"`
+	// A read that needs control group approval (Vault Enterprise) comes back
+	// wrapped instead, see controlgroup.go.
+	WrapInfo *VaultWrapInfo `json:"wrap_info"`
+}
+
+// VaultRenewResponse handles fields we care about from renewing the token.
+type VaultRenewResponse struct {
+	Errors []string `json:"errors"`
+	Auth   struct {
+		LeaseDuration int64 `json:"lease_duration"`
+	}
+}
+
+// VaultLookupTokenResponse is used just for determining renewability
+type VaultLookupTokenResponse struct {
+	Errors []string `json:"errors"`
+	Data   struct {
+		Renewable bool `json:"renewable"`
+	}
+}
+
+// VaultCapabilitiesResponse handles fields we care about from looking up a
+// token's capabilities; the capabilities themselves are keyed by path.
+type VaultCapabilitiesResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// VaultRevokeResponse handles fields we care about from revoking a lease.
+type VaultRevokeResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// VaultAuthError is returned for requests that vault rejected because the
+// token was missing, invalid, expired, or didn't have permission.
+type VaultAuthError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *VaultAuthError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vault server error (HTTP status %d): permission denied", e.StatusCode)
+	}
+	return fmt.Sprintf("vault server error (HTTP status %d): %s", e.StatusCode, strings.Join(e.Errors, ","))
+}
+
+// GenerateConfigOptions describe how to run the command that generates a
+// vault config.
+type GenerateConfigOptions struct {
+	Command string // The command line to run
+	Shell   bool   // Run with the system shell rather than splitting into arguments
+
+	// If CacheFile is set, the command's output is cached there and reused for
+	// CacheTTL rather than running the command again.
+	CacheFile string
+	CacheTTL  time.Duration
+}
+
+// runConfigGenerator runs the generate-config command with env added to its
+// environment, and returns its output.  If options.Shell is set the command is
+// run with the system shell, otherwise it is split into a command and its
+// arguments.
+func runConfigGenerator(options GenerateConfigOptions, env []string) ([]byte, error) {
+	var cmd *exec.Cmd
+
+	if options.Shell {
+		cmd = shellCommand(options.Command)
+	} else {
+		args, err := splitCommandLine(options.Command)
+		if err != nil {
+			return nil, fmt.Errorf("invalid generate-config command: %s", err)
+		}
+		if len(args) == 0 {
+			return nil, errors.New("invalid generate-config command: empty command")
+		}
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+
+	var stdoutBytes bytes.Buffer
+	cmd.Stdout = &stdoutBytes
+
+	// We'll just pipe stderr back to stderr
+	cmd.Stderr = os.Stderr
+
+	// Merge vault config environment variables
+	cmd.Env = append(os.Environ(), env...)
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return stdoutBytes.Bytes(), nil
+}
+
+// configGeneratorEnv returns the environment variables the generate-config
+// command is given: the command vaultexec will run as VAULTEXEC_COMMAND, and
+// the vault config so far.
+func configGeneratorEnv(command []string, config VaultConfig) []string {
+	var env []string
+	if len(command) > 0 {
+		env = append(env, fmt.Sprintf("VAULTEXEC_COMMAND=%s", QuoteCommandLine(command)))
+	}
+	if len(config.Address) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_ADDR=%s", config.Address))
+	}
+	if len(config.Token) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_TOKEN=%s", config.Token))
+	}
+	if len(config.Path) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_PATH=%s", config.Path))
+	}
+	if len(config.PathDelim) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_PATH_DELIM=%s", config.PathDelim))
+	}
+	if len(config.CACert) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_CACERT=%s", config.CACert))
+	}
+	if len(config.CAPath) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_CAPATH=%s", config.CAPath))
+	}
+	if len(config.ClientCert) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_CLIENT_CERT=%s", config.ClientCert))
+	}
+	if len(config.ClientKey) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_CLIENT_KEY=%s", config.ClientKey))
+	}
+	if config.TLSSkipVerify {
+		env = append(env, "VAULT_SKIP_VERIFY=true")
+	}
+	if len(config.TLSServerName) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_TLS_SERVER_NAME=%s", config.TLSServerName))
+	}
+	if len(config.Proxy) > 0 {
+		env = append(env, fmt.Sprintf("VAULT_HTTP_PROXY=%s", config.Proxy))
+	}
+
+	return env
+}
+
+// GenerateVaultConfig creates a new vault config by running a given command on
+// the system.  Will merge the passed in config with the environment variables
+// passed to vaultexec to run the command.  If a cache file is configured, the
+// output of a previous run is used instead until it expires.
+func GenerateVaultConfig(options GenerateConfigOptions, command []string, config VaultConfig) (VaultConfig, error) {
+	env := configGeneratorEnv(command, config)
+	stdoutBytes, cached := readGenerateConfigCache(options, env)
+
+	if !cached {
+		var err error
+		stdoutBytes, err = runConfigGenerator(options, env)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	stdoutVaultConfig, err := parseGeneratedVaultConfig(stdoutBytes)
+
+	if err != nil {
+		return config, err
+	}
+
+	RedactToken(stdoutVaultConfig.Token)
+
+	LogDebugf("Generated vault config provides: %s", strings.Join(generatedConfigKeys(stdoutBytes), ", "))
+
+	// Only cache output that could be used.
+	if !cached && len(options.CacheFile) > 0 {
+		err = writeGenerateConfigCache(options, env, stdoutBytes)
+		if err != nil {
+			LogErrorf("error caching generated vault config: %s", err)
+		}
+	}
+
+	if len(stdoutVaultConfig.Address) > 0 {
+		config.Address = stdoutVaultConfig.Address
+	}
+	if len(stdoutVaultConfig.Token) > 0 {
+		config.Token = stdoutVaultConfig.Token
+	}
+	if len(stdoutVaultConfig.Path) > 0 {
+		config.Path = stdoutVaultConfig.Path
+	}
+	if len(stdoutVaultConfig.PathDelim) > 0 {
+		config.PathDelim = stdoutVaultConfig.PathDelim
+	}
+	if len(stdoutVaultConfig.CACert) > 0 {
+		config.CACert = stdoutVaultConfig.CACert
+	}
+	if len(stdoutVaultConfig.CAPath) > 0 {
+		config.CAPath = stdoutVaultConfig.CAPath
+	}
+	if len(stdoutVaultConfig.ClientCert) > 0 {
+		config.ClientCert = stdoutVaultConfig.ClientCert
+	}
+	if len(stdoutVaultConfig.ClientKey) > 0 {
+		config.ClientKey = stdoutVaultConfig.ClientKey
+	}
+	if stdoutVaultConfig.TLSSkipVerify {
+		config.TLSSkipVerify = true
+	}
+	if len(stdoutVaultConfig.TLSServerName) > 0 {
+		config.TLSServerName = stdoutVaultConfig.TLSServerName
+	}
+	if len(stdoutVaultConfig.Proxy) > 0 {
+		config.Proxy = stdoutVaultConfig.Proxy
+	}
+
+	return config, nil
+}
+
+// parseGeneratedVaultConfig parses the output of the generate-config command,
+// which must be a JSON object of known fields with values of the right type.
+func parseGeneratedVaultConfig(stdoutBytes []byte) (VaultConfig, error) {
+	var stdoutVaultConfig VaultConfig
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(stdoutBytes, &fields)
+	if err != nil {
+		return stdoutVaultConfig, fmt.Errorf("generate-config output must be a JSON object: %s", err)
+	}
+
+	// The fields that can be generated are those of VaultConfig with a name.
+	var known []string
+	configType := reflect.TypeOf(stdoutVaultConfig)
+	for i := 0; i < configType.NumField(); i++ {
+		name := strings.Split(configType.Field(i).Tag.Get("json"), ",")[0]
+		if len(name) > 0 && name != "-" {
+			known = append(known, name)
+		}
+	}
+
+	for _, name := range generatedConfigKeys(stdoutBytes) {
+		if !containsString(known, name) {
+			if suggestion := ClosestName(name, known); len(suggestion) > 0 {
+				return stdoutVaultConfig, fmt.Errorf("generate-config output has unknown field %s (did you mean %s?)", name, suggestion)
+			}
+			return stdoutVaultConfig, fmt.Errorf("generate-config output has unknown field %s, must be one of: %s", name, strings.Join(known, ", "))
+		}
+	}
+
+	err = json.Unmarshal(stdoutBytes, &stdoutVaultConfig)
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return stdoutVaultConfig, fmt.Errorf("generate-config output field %s must be a %s, not a %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+
+	return stdoutVaultConfig, err
+}
+
+// containsString returns whether s is in values.
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// generatedConfigKeys returns the names of the options provided in the output
+// of the generate-config command, for logging without their values.
+func generatedConfigKeys(stdoutBytes []byte) []string {
+	var generated map[string]interface{}
+	json.Unmarshal(stdoutBytes, &generated)
+
+	keys := make([]string, 0, len(generated))
+	for k := range generated {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// NewVaultConfig creates a new VaultConfig from the values provided as command
+// line options, substituting env when appropriate
+func NewVaultConfig(flagConfig VaultConfig) (VaultConfig, error) {
+	config := flagConfig
+
+	// Then if any options are still blank we read the environment variables.
+	envStrings := []struct {
+		value *string
+		name  string
+	}{
+		{&config.Address, "VAULT_ADDR"},
+		{&config.Token, "VAULT_TOKEN"},
+		{&config.Path, "VAULT_PATH"},
+		{&config.CACert, "VAULT_CACERT"},
+		{&config.CAPath, "VAULT_CAPATH"},
+		{&config.ClientCert, "VAULT_CLIENT_CERT"},
+		{&config.ClientKey, "VAULT_CLIENT_KEY"},
+		{&config.TLSServerName, "VAULT_TLS_SERVER_NAME"},
+		{&config.Proxy, "VAULT_HTTP_PROXY"},
+		{&config.VaultIndex, "VAULT_INDEX"},
+	}
+	for _, env := range envStrings {
+		if len(*env.value) == 0 && len(os.Getenv(env.name)) > 0 {
+			*env.value = os.Getenv(env.name)
+			LogDebugf("Using %s from the environment", env.name)
+		}
+	}
+
+	if !config.TLSSkipVerify && len(os.Getenv("VAULT_SKIP_VERIFY")) > 0 {
+		skipVerify, err := strconv.ParseBool(os.Getenv("VAULT_SKIP_VERIFY"))
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_SKIP_VERIFY: %s", err)
+		}
+		config.TLSSkipVerify = skipVerify
+		LogDebugf("Using VAULT_SKIP_VERIFY from the environment")
+	}
+
+	// As with the path delimeter below, the request timeout has a default so we
+	// only swap in the environment value if the option was left at that default.
+	if config.RequestTimeout == DefaultRequestTimeout && len(os.Getenv("VAULT_CLIENT_TIMEOUT")) > 0 {
+		requestTimeout, err := parseDurationOrSeconds(os.Getenv("VAULT_CLIENT_TIMEOUT"))
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_CLIENT_TIMEOUT: %s", err)
+		}
+		config.RequestTimeout = requestTimeout
+		LogDebugf("Using VAULT_CLIENT_TIMEOUT from the environment")
+	}
+
+	if config.RateLimit == 0 && len(os.Getenv("VAULT_RATE_LIMIT")) > 0 {
+		rateLimit, rateLimitBurst, err := parseRateLimit(os.Getenv("VAULT_RATE_LIMIT"))
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_RATE_LIMIT: %s", err)
+		}
+		config.RateLimit = rateLimit
+		if config.RateLimitBurst == 0 {
+			config.RateLimitBurst = rateLimitBurst
+		}
+		LogDebugf("Using VAULT_RATE_LIMIT from the environment")
+	}
+
+	// As with the path delimeter below, max retries has a default so we only
+	// swap in the environment value if the option was left at that default.
+	if config.MaxRetries == DefaultMaxRetries && len(os.Getenv("VAULT_MAX_RETRIES")) > 0 {
+		maxRetries, err := strconv.Atoi(os.Getenv("VAULT_MAX_RETRIES"))
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_MAX_RETRIES: %s", err)
+		}
+		config.MaxRetries = maxRetries
+		LogDebugf("Using VAULT_MAX_RETRIES from the environment")
+	}
+
+	// Because we default path delimeter to a comma, we check if it's blank or
+	// if it's the default value - and then only swap in the environment value if
+	// it's not blank.
+	if len(config.PathDelim) == 0 || config.PathDelim == "," {
+		if len(os.Getenv("VAULT_PATH_DELIM")) != 0 {
+			config.PathDelim = os.Getenv("VAULT_PATH_DELIM")
+			LogDebugf("Using VAULT_PATH_DELIM from the environment")
+		}
+	}
+
+	// Ensure that the addresses don't end in a trailing slash.
+	config.Address = strings.Join(splitVaultAddresses(config.Address), ",")
+
+	return config, nil
+}
+
+// parseDurationOrSeconds parses a duration such as "1m30s", or a bare number of
+// seconds.
+func parseDurationOrSeconds(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// ValidateVaultConfig validates a given vaultconfig and returns an error if invalid.
+func ValidateVaultConfig(config VaultConfig) error {
+	err := ValidateVaultConnectionConfig(config)
+
+	if err != nil {
+		return err
+	}
+
+	if len(config.Path) == 0 {
+		return errors.New("missing vault secret path")
+	}
+
+	if len(config.PathDelim) == 0 {
+		return errors.New("missing vault secret path delimeter")
+	}
+
+	return nil
+}
+
+// ValidateVaultConnectionConfig validates the parts of a vaultconfig needed to
+// make requests to vault (but not to fetch secrets) and returns an error if
+// invalid.
+func ValidateVaultConnectionConfig(config VaultConfig) error {
+
+	if len(config.Address) == 0 {
+		return errors.New("missing vault address")
+	}
+
+	var err error
+
+	for _, address := range splitVaultAddresses(config.Address) {
+		_, err = url.ParseRequestURI(address)
+
+		if err != nil {
+			return fmt.Errorf("invalid vault address: %s", err)
+		}
+	}
+
+	if len(config.Token) == 0 {
+		return errors.New("missing vault token")
+	}
+
+	if len(config.Proxy) > 0 {
+		_, err = url.Parse(config.Proxy)
+
+		if err != nil {
+			return fmt.Errorf("invalid vault proxy: %s", err)
+		}
+	}
+
+	if config.RequestTimeout < 0 {
+		return errors.New("vault request timeout must not be negative")
+	}
+
+	if config.DialTimeout < 0 {
+		return errors.New("vault dial timeout must not be negative")
+	}
+
+	if config.MaxRetries < 0 {
+		return errors.New("vault max retries must not be negative")
+	}
+
+	if config.UnavailableTimeout < 0 {
+		return errors.New("vault unavailable retry timeout must not be negative")
+	}
+
+	if config.FetchConcurrency < 0 {
+		return errors.New("fetch concurrency must not be negative")
+	}
+
+	if config.ControlGroupTimeout < 0 {
+		return errors.New("control group timeout must not be negative")
+	}
+
+	if len(config.InconsistentRead) > 0 && config.InconsistentRead != InconsistentForwardActiveNode && config.InconsistentRead != InconsistentFail {
+		return fmt.Errorf("invalid inconsistent read behavior %q, must be %s or %s",
+			config.InconsistentRead, InconsistentForwardActiveNode, InconsistentFail)
+	}
+
+	if config.RateLimit < 0 || config.RateLimitBurst < 0 {
+		return errors.New("vault rate limit and burst must not be negative")
+	}
+
+	if config.RetryWaitMin > config.RetryWaitMax {
+		return errors.New("vault minimum retry wait must not exceed the maximum retry wait")
+	}
+
+	if len(config.ClientCert) > 0 && len(config.ClientKey) == 0 {
+		return errors.New("missing vault client key for client certificate")
+	}
+
+	if len(config.ClientKey) > 0 && len(config.ClientCert) == 0 {
+		return errors.New("missing vault client certificate for client key")
+	}
+
+	return nil
+}
+
+// newVaultTLSConfig builds the TLS configuration for connecting to vault from
+// the certificate options in the config.
+func newVaultTLSConfig(config VaultConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.TLSSkipVerify,
+		ServerName:         config.TLSServerName,
+	}
+
+	if len(config.CACert) > 0 || len(config.CAPath) > 0 {
+		rootCAs := x509.NewCertPool()
+
+		caFiles := []string{}
+		if len(config.CACert) > 0 {
+			caFiles = append(caFiles, config.CACert)
+		}
+		if len(config.CAPath) > 0 {
+			fileInfos, err := ioutil.ReadDir(config.CAPath)
+			if err != nil {
+				return nil, fmt.Errorf("error reading vault CA path: %s", err)
+			}
+			for _, fileInfo := range fileInfos {
+				if !fileInfo.IsDir() {
+					caFiles = append(caFiles, filepath.Join(config.CAPath, fileInfo.Name()))
+				}
+			}
+		}
+
+		for _, caFile := range caFiles {
+			pemBytes, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading vault CA certificate: %s", err)
+			}
+			if !rootCAs.AppendCertsFromPEM(pemBytes) {
+				return nil, fmt.Errorf("no valid certificates found in %s", caFile)
+			}
+		}
+
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if len(config.ClientCert) > 0 {
+		clientCert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading vault client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// newVaultHTTPClient creates an HTTP client configured to talk to the vault
+// server described by the config.
+func newVaultHTTPClient(config VaultConfig) (*http.Client, error) {
+	tlsConfig, err := newVaultTLSConfig(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Honor the standard proxy environment variables unless a proxy was
+	// explicitly configured.
+	proxy := http.ProxyFromEnvironment
+	if len(config.Proxy) > 0 {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vault proxy: %s", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	// Keep connections alive between requests so that fetching many paths and
+	// renewing the token don't each pay for a new TLS handshake.
+	transport := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: config.DialTimeout,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.RequestTimeout,
+		// Redirects are followed by doVaultRequest.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// WithVaultClient returns a copy of the config with an HTTP client built from
+// it, which is then reused by every request made with the returned config.
+// The config should be complete and validated before calling this.
+func WithVaultClient(config VaultConfig) (VaultConfig, error) {
+	httpClient, err := newVaultHTTPClient(config)
+
+	if err != nil {
+		return config, err
+	}
+
+	RedactToken(config.Token)
+
+	config.client = &vaultClient{
+		httpClient: httpClient,
+		addresses:  splitVaultAddresses(config.Address),
+		limiter:    newRateLimiter(config.RateLimit, config.RateLimitBurst),
+		vaultIndex: config.VaultIndex,
+	}
+
+	return config, nil
+}
+
+// Make a request to the vault service with a given method.  If payload is not
+// nil it will be encoded as JSON and sent as the request body.  Idempotent
+// requests that fail with a transient error are retried with backoff.
+func makeVaultRequest(method string, path string, payload interface{}, config VaultConfig) ([]byte, error) {
+	var err error
+
+	// Fall back to a one-off client if the config wasn't set up with a shared one.
+	if config.client == nil {
+		config, err = WithVaultClient(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client := config.client
+
+	var payloadBytes []byte
+	if payload != nil {
+		payloadBytes, err = json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resp *vaultResponse
+	var unavailableSince time.Time
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err = doVaultRequestWithFailover(client, method, path, payloadBytes, config)
+
+		if err != nil {
+			LogDebugf("%s %s failed after %s (retry %d): %s", method, path, time.Since(start), attempt, err)
+		} else {
+			LogDebugf("%s %s returned %d in %s (retry %d)", method, path, resp.StatusCode, time.Since(start), attempt)
+		}
+
+		// While vault is sealed or has no active node (e.g. during
+		// maintenance), requests are retried until UnavailableTimeout has
+		// passed rather than MaxRetries times.  Vault doesn't handle any
+		// request in that state, so even those that aren't idempotent (e.g.
+		// logging in) are safe to send again.  sys/health reports the same
+		// state as a 503, which WaitForVault polls for itself.
+		reason := vaultUnavailableReason(resp, err)
+		if len(reason) > 0 && config.UnavailableTimeout > 0 && !strings.HasPrefix(path, "v1/sys/health") {
+			if unavailableSince.IsZero() {
+				unavailableSince = start
+			}
+
+			wait := retryBackoff(attempt, resp, config)
+			if remaining := config.UnavailableTimeout - time.Since(unavailableSince); wait < remaining {
+				LogWarnf("Vault is unavailable (%s), retrying %s %s in %s (for up to %s more)",
+					reason, method, path, wait, remaining.Round(time.Second))
+				time.Sleep(wait)
+				continue
+			}
+		}
+
+		if !isIdempotentMethod(method) || attempt >= config.MaxRetries || !shouldRetryVaultRequest(resp, err) {
+			break
+		}
+
+		wait := retryBackoff(attempt, resp, config)
+		LogWarnf("Retrying %s %s in %s (attempt %d of %d)", method, path, wait, attempt+1, config.MaxRetries)
+		time.Sleep(wait)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		authErr := &VaultAuthError{StatusCode: resp.StatusCode}
+		var errorResponse VaultRevokeResponse
+		if json.Unmarshal(resp.Body, &errorResponse) == nil {
+			authErr.Errors = errorResponse.Errors
+		}
+		return nil, authErr
+	}
+
+	// Some endpoints (e.g. revoking a lease) intentionally return no content.
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	if len(resp.Body) == 0 {
+		return nil, fmt.Errorf(
+			"vault server error (HTTP status %d): empty response",
+			resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+// vaultResponse is the raw result of a single request to the vault server.
+type vaultResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// doVaultRequest makes a single attempt at a request to the vault server.
+// Standby nodes answer with a 307 redirect to the active node, which is
+// followed here (rather than by net/http) so that the method, body, and every
+// header including the token are sent again as-is.
+func doVaultRequest(client *vaultClient, method string, requestURL string, payloadBytes []byte, config VaultConfig) (*vaultResponse, error) {
+	for redirects := 0; ; redirects++ {
+		resp, err := doVaultRequestOnce(client, method, requestURL, payloadBytes, config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusTemporaryRedirect && resp.StatusCode != http.StatusPermanentRedirect {
+			return resp, nil
+		}
+
+		if redirects >= maxVaultRedirects {
+			return nil, fmt.Errorf("vault server error: stopped after %d redirects", maxVaultRedirects)
+		}
+
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || len(location.String()) == 0 {
+			return nil, fmt.Errorf("vault server error: invalid redirect location %q", resp.Header.Get("Location"))
+		}
+
+		currentURL, err := url.Parse(requestURL)
+		if err != nil {
+			return nil, err
+		}
+
+		requestURL = currentURL.ResolveReference(location).String()
+	}
+}
+
+// doVaultRequestOnce sends a single HTTP request to the vault server, without
+// following any redirects.
+func doVaultRequestOnce(client *vaultClient, method string, requestURL string, payloadBytes []byte, config VaultConfig) (*vaultResponse, error) {
+	var body io.Reader
+	if payloadBytes != nil {
+		body = bytes.NewReader(payloadBytes)
+	}
+
+	req, err := http.NewRequest(method, requestURL, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range config.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	// Logging in is done without a token.
+	if len(config.Token) > 0 {
+		req.Header.Set("X-Vault-Token", config.Token)
+	}
+
+	client.setConsistencyHeaders(req, config)
+
+	resp, err := client.httpClient.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client.recordVaultIndex(resp)
+
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &vaultResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       bodyBytes,
+	}, nil
+}
+
+// VaultSecrets is the merged result of fetching every secret path.
+type VaultSecrets struct {
+	Values     map[string]interface{}
+	Sources    map[string]string // The path each key's value was read from
+	SourceKeys map[string]string // The key each value was read as, before key naming
+	LeaseIDs   []string          // Leases of any dynamic secrets
+	Reads      []SecretRead      // Every path read, in order
+}
+
+// SecretRead is a path that secrets were read from, and the keys read.
+type SecretRead struct {
+	Path string
+	Keys []string
+}
+
+// GetVaultSecrets loops through all of the secret paths that are provided and
+// returns the merged results of every lookup from vault (or another secret
+// source, see RegisterSecretSource), along with where each
+// key came from and the lease IDs of any dynamic secrets that were fetched.
+func GetVaultSecrets(config VaultConfig) (VaultSecrets, error) {
+	// These are the secrets we will return by merging the results of each fetch.
+	mergedSecrets := VaultSecrets{
+		Values:     make(map[string]interface{}),
+		Sources:    make(map[string]string),
+		SourceKeys: make(map[string]string),
+	}
+
+	paths := strings.Split(config.Path, config.PathDelim)
+	start := time.Now()
+
+	results := fetchSecretsConcurrently(paths, config)
+
+	// The results are merged in the order the paths were given, so later paths
+	// override earlier ones however long each took to fetch.
+	for i, path := range paths {
+		result := results[i]
+		if result.err != nil {
+			metrics.recordFetch(time.Since(start), result.err)
+			return VaultSecrets{}, result.err
+		}
+
+		// A leased path referenced more than once is only read once.
+		if len(result.leaseID) > 0 && !containsString(mergedSecrets.LeaseIDs, result.leaseID) {
+			mergedSecrets.LeaseIDs = append(mergedSecrets.LeaseIDs, result.leaseID)
+		}
+
+		read := SecretRead{Path: path, Keys: make([]string, 0, len(result.secrets))}
+
+		redactSecretValues(result.secrets)
+
+		for key, v := range result.secrets {
+			k := config.KeyNaming.keyName(path, key)
+			read.Keys = append(read.Keys, k)
+			if previous, ok := mergedSecrets.Sources[k]; ok {
+				LogDebugf("Key %s from %s overrides the value from %s", k, path, previous)
+			}
+			mergedSecrets.Values[k] = v
+			mergedSecrets.Sources[k] = path
+			mergedSecrets.SourceKeys[k] = key
+		}
+
+		sort.Strings(read.Keys)
+		mergedSecrets.Reads = append(mergedSecrets.Reads, read)
+
+		LogDebugf("Read %d keys from %s", len(result.secrets), path)
+	}
+
+	metrics.recordFetch(time.Since(start), nil)
+
+	return mergedSecrets, nil
+}
+
+// fetchResult is the result of fetching a single path.
+type fetchResult struct {
+	secrets map[string]interface{}
+	leaseID string
+	err     error
+}
+
+// fetchSecretsConcurrently fetches every path with up to
+// config.FetchConcurrency fetches at once, returning the results in the same
+// order as the paths.  Each path in a source is only read once, however many
+// times it's referenced.  Once a fetch fails, paths that haven't been started
+// are skipped.
+func fetchSecretsConcurrently(paths []string, config VaultConfig) []fetchResult {
+	results := make([]fetchResult, len(paths))
+
+	workers := config.FetchConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	cache := newFetchCache()
+	indexes := make(chan int)
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result := &results[i]
+				result.secrets, result.leaseID, result.err = fetchSecrets(paths[i], config, cache)
+				if result.err != nil {
+					failOnce.Do(func() { close(failed) })
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := range paths {
+		select {
+		case indexes <- i:
+		case <-failed:
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// GetVaultSecretsAtPath does a lookup for a specific secret path from vault
+// and returns a map with the result, along with the lease ID if the secret is
+// leased.
+func GetVaultSecretsAtPath(path string, config VaultConfig) (map[string]interface{}, string, error) {
+	bodyBytes, err := makeVaultRequest("GET", "v1/"+path, nil, config)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The secrets are copied out of the response when it's decoded.
+	defer zeroBytes(bodyBytes)
+
+	var vaultSecretResponse VaultSecretResponse
+
+	err = json.Unmarshal(bodyBytes, &vaultSecretResponse)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if vaultSecretResponse.WrapInfo != nil && len(vaultSecretResponse.WrapInfo.Accessor) > 0 {
+		vaultSecretResponse, err = waitForControlGroup(path, *vaultSecretResponse.WrapInfo, config)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if len(vaultSecretResponse.Errors) > 0 {
+		return nil, "", fmt.Errorf(
+			"vault server error: %s",
+			strings.Join(vaultSecretResponse.Errors, ","))
+	}
+
+	return vaultSecretResponse.Data, vaultSecretResponse.LeaseID, nil
+}
+
+// RenewVaultToken attempts to renew the token provided in the config, returns
+// the lease expiration and an error.  If increment is non-zero it is sent as
+// the requested lease length, otherwise the backend default is used.
+func RenewVaultToken(config VaultConfig, increment time.Duration) (int64, error) {
+	var payload interface{}
+	if increment > 0 {
+		payload = map[string]int64{"increment": int64(increment / time.Second)}
+	}
+
+	bodyBytes, err := makeVaultRequest("POST", "v1/auth/token/renew-self", payload, config)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var vaultRenewResponse VaultRenewResponse
+
+	err = json.Unmarshal(bodyBytes, &vaultRenewResponse)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(vaultRenewResponse.Errors) > 0 {
+		return 0, fmt.Errorf(
+			"vault server error: %s",
+			strings.Join(vaultRenewResponse.Errors, ","))
+	}
+
+	return vaultRenewResponse.Auth.LeaseDuration, nil
+}
+
+// GetVaultTokenRenewable returns whether or not a VaultConfig has a renewable token
+func GetVaultTokenRenewable(config VaultConfig) (bool, error) {
+	bodyBytes, err := makeVaultRequest("GET", "v1/auth/token/lookup-self", nil, config)
+
+	if err != nil {
+		return false, err
+	}
+
+	var vaultLookupTokenResponse VaultLookupTokenResponse
+
+	err = json.Unmarshal(bodyBytes, &vaultLookupTokenResponse)
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(vaultLookupTokenResponse.Errors) > 0 {
+		return false, fmt.Errorf(
+			"vault server error: %s",
+			strings.Join(vaultLookupTokenResponse.Errors, ","))
+	}
+
+	return vaultLookupTokenResponse.Data.Renewable, nil
+}
+
+// KeepVaultTokenRenewed renews the token provided in the config periodically
+// (half of every lease duration), starting right away.  It blocks until the
+// token can't be renewed, so is usually run in its own goroutine.  increment
+// is passed on to RenewVaultToken.
+func KeepVaultTokenRenewed(config VaultConfig, increment time.Duration) {
+	renewable, err := GetVaultTokenRenewable(config)
+
+	if err != nil {
+		LogErrorf("error determining renewable token: %s", err)
+		return
+	}
+
+	if !renewable {
+		return
+	}
+
+	leaseTimeout := 0 * time.Second
+	for {
+		time.Sleep(leaseTimeout * time.Second)
+		leaseDuration, err := RenewVaultToken(config, increment)
+		metrics.recordRenewal(time.Duration(leaseDuration)*time.Second, err)
+		if err != nil {
+			LogErrorf("error renewing vault token: %s", err)
+			notify(Event{Event: EventRenewalFailure, Message: err.Error()})
+			// If there was an error renewing the token, it should stop trying to
+			// renew (otherwise it will repeatedly try to renew with no delay)
+			return
+		}
+		leaseTimeout = time.Duration(leaseDuration) / 2
+	}
+}
+
+// GetVaultTokenCapabilities returns the capabilities (e.g. read, list, deny)
+// the token in the config has on each of the given paths.
+func GetVaultTokenCapabilities(paths []string, config VaultConfig) (map[string][]string, error) {
+	payload := map[string][]string{"paths": paths}
+
+	bodyBytes, err := makeVaultRequest("POST", "v1/sys/capabilities-self", payload, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var vaultCapabilitiesResponse VaultCapabilitiesResponse
+
+	err = json.Unmarshal(bodyBytes, &vaultCapabilitiesResponse)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(vaultCapabilitiesResponse.Errors) > 0 {
+		return nil, fmt.Errorf(
+			"vault server error: %s",
+			strings.Join(vaultCapabilitiesResponse.Errors, ","))
+	}
+
+	// The capabilities for each path are returned as top level keys, alongside
+	// some other fields that we don't care about.
+	var capabilitiesByPath map[string]interface{}
+
+	err = json.Unmarshal(bodyBytes, &capabilitiesByPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities := make(map[string][]string)
+	for _, path := range paths {
+		values, _ := capabilitiesByPath[path].([]interface{})
+		for _, value := range values {
+			if capability, ok := value.(string); ok {
+				capabilities[path] = append(capabilities[path], capability)
+			}
+		}
+	}
+
+	return capabilities, nil
+}
+
+// RevokeVaultLease revokes the lease with the given ID, invalidating any dynamic
+// credentials that were issued with it.
+func RevokeVaultLease(leaseID string, config VaultConfig) error {
+	payload := map[string]string{"lease_id": leaseID}
+
+	bodyBytes, err := makeVaultRequest("PUT", "v1/sys/leases/revoke", payload, config)
+
+	if err != nil {
+		return err
+	}
+
+	// A successful revoke returns no content.
+	if bodyBytes == nil {
+		return nil
+	}
+
+	var vaultRevokeResponse VaultRevokeResponse
+
+	err = json.Unmarshal(bodyBytes, &vaultRevokeResponse)
+
+	if err != nil {
+		return err
+	}
+
+	if len(vaultRevokeResponse.Errors) > 0 {
+		return fmt.Errorf(
+			"vault server error: %s",
+			strings.Join(vaultRevokeResponse.Errors, ","))
+	}
+
+	return nil
+}
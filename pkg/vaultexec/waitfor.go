@@ -0,0 +1,125 @@
+package vaultexec
+
+// waitfor.go includes waiting for the services a command depends on (e.g. its
+// database) to be reachable before it's run, since vaultexec is often the
+// entrypoint of a container anyway, in place of a separate wait-for-it script.
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How often unreachable dependencies are checked again.
+const waitForDependencyInterval = time.Second
+
+// How long a single check of a dependency can take.
+const dependencyCheckTimeout = 5 * time.Second
+
+// ParseDependencies parses a comma separated list of dependencies, each either
+// tcp://host:port (reachable once it accepts a connection) or an http:// or
+// https:// URL (reachable once it responds with a 2xx status).
+func ParseDependencies(list string) ([]*url.URL, error) {
+	var dependencies []*url.URL
+
+	for _, dependency := range strings.Split(list, ",") {
+		dependency = strings.TrimSpace(dependency)
+		if len(dependency) == 0 {
+			continue
+		}
+
+		u, err := url.Parse(dependency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dependency %s: %s", dependency, err)
+		}
+
+		switch u.Scheme {
+		case "tcp":
+			if _, _, err := net.SplitHostPort(u.Host); err != nil {
+				return nil, fmt.Errorf("invalid dependency %s: must be tcp://host:port", dependency)
+			}
+		case "http", "https":
+			if len(u.Host) == 0 {
+				return nil, fmt.Errorf("invalid dependency %s: missing host", dependency)
+			}
+		default:
+			return nil, fmt.Errorf("invalid dependency %s: must be a tcp://, http://, or https:// URL", dependency)
+		}
+
+		dependencies = append(dependencies, u)
+	}
+
+	return dependencies, nil
+}
+
+// WaitForDependencies waits until every dependency is reachable, or returns an
+// error once timeout has passed (0 to wait forever).
+func WaitForDependencies(dependencies []*url.URL, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	lastReasons := map[string]string{}
+
+	for {
+		var waiting []*url.URL
+		for _, dependency := range dependencies {
+			err := checkDependency(dependency)
+			if err == nil {
+				if _, ok := lastReasons[dependency.String()]; ok {
+					LogInfof("%s is reachable", dependency)
+				}
+				continue
+			}
+
+			waiting = append(waiting, dependency)
+			if reason := err.Error(); lastReasons[dependency.String()] != reason {
+				LogInfof("Waiting for %s: %s", dependency, reason)
+				lastReasons[dependency.String()] = reason
+			}
+		}
+
+		if len(waiting) == 0 {
+			return nil
+		}
+
+		if !deadline.IsZero() && time.Now().Add(waitForDependencyInterval).After(deadline) {
+			names := make([]string, len(waiting))
+			for i, dependency := range waiting {
+				names[i] = dependency.String()
+			}
+			return fmt.Errorf("timed out after %s waiting for %s", timeout, strings.Join(names, ", "))
+		}
+
+		dependencies = waiting
+		time.Sleep(waitForDependencyInterval)
+	}
+}
+
+// checkDependency returns why a dependency isn't reachable, or nil if it is.
+func checkDependency(dependency *url.URL) error {
+	if dependency.Scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", dependency.Host, dependencyCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := &http.Client{Timeout: dependencyCheckTimeout}
+	resp, err := client.Get(dependency.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package vaultexec
+
+// zeroize.go includes functions for limiting how long secrets stay in
+// vaultexec's memory.  Go strings can't be overwritten, so only byte buffers
+// are zeroed; strings are dropped so that the garbage collector can free them.
+
+import (
+	"runtime/debug"
+)
+
+// zeroBytes overwrites a buffer that held secrets.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// ForgetSecretValues removes every value from values and returns the memory
+// they used to the operating system, so that secrets aren't kept in memory
+// for longer than they are needed.
+func ForgetSecretValues(values map[string]interface{}) {
+	for k := range values {
+		delete(values, k)
+	}
+	forgetRedactedValues()
+	debug.FreeOSMemory()
+}
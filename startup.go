@@ -0,0 +1,129 @@
+package main
+
+// startup.go includes the startup deadline for exec, which bounds connecting
+// to vault and fetching the secrets so that a slow vault can't hang the launch
+// of the command indefinitely.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/funnylookinhat/vaultexec/pkg/vaultexec"
+)
+
+// What exec does when the startup deadline passes.
+const (
+	startupPolicyFail  = "fail"  // Exit with ExitFetchError
+	startupPolicyCache = "cache" // Run the command with the cached secrets
+	startupPolicyEmpty = "empty" // Run the command without secrets
+)
+
+var startupPolicies = []string{startupPolicyFail, startupPolicyCache, startupPolicyEmpty}
+
+// startExec connects to vault and fetches the secrets for exec, returning the
+// config, the secrets, and whether they came from vault.  If that takes longer
+// than -startup-timeout, the secrets are chosen by -startup-timeout-policy
+// instead.  Whatever was already under way in the background (e.g. the
+// generate-config command) is left to finish without affecting the command,
+// but the secrets aren't fetched.
+func startExec(flagConfig vaultexec.VaultConfig, options Options, cmd []string) (vaultexec.VaultConfig, vaultexec.VaultSecrets, bool) {
+	errCheck(checkStartupPolicy(options), ExitConfigError)
+
+	type startup struct {
+		config       vaultexec.VaultConfig
+		vaultSecrets vaultexec.VaultSecrets
+		err          error
+	}
+
+	// Errors are returned rather than exiting, so that a late failure can't
+	// stop a command that was started after the deadline.
+	started := make(chan startup, 1)
+	abandoned := make(chan struct{})
+	go func() {
+		config, err := connectToVault(flagConfig, options, cmd, true)
+		if err != nil {
+			started <- startup{err: err}
+			return
+		}
+
+		select {
+		case <-abandoned:
+			vaultexec.LogDebugf("Not fetching the secrets, since the command was started after the startup deadline")
+			return
+		default:
+		}
+
+		vaultSecrets, err := fetchCheckedSecrets(config, options)
+		started <- startup{config, vaultSecrets, err}
+	}()
+
+	// Without a timeout, this is never ready.
+	var deadline <-chan time.Time
+	if options.StartupTimeout > 0 {
+		deadline = time.After(options.StartupTimeout)
+	}
+
+	select {
+	case s := <-started:
+		errCheck(s.err, ExitFetchError)
+		return s.config, s.vaultSecrets, true
+	case <-deadline:
+		close(abandoned)
+	}
+
+	err := fmt.Errorf("timed out after %s connecting to vault and fetching the secrets", options.StartupTimeout)
+
+	vaultSecrets, err := startupTimeoutSecrets(flagConfig, options, err)
+	errCheck(err, ExitFetchError)
+	errCheck(checkSecrets(vaultSecrets, options), ExitFetchError)
+	vaultexec.RecordStartupPolicy(options.StartupPolicy)
+
+	return vaultexec.VaultConfig{}, vaultSecrets, false
+}
+
+// checkStartupPolicy checks that -startup-timeout-policy is valid, and can be
+// followed with the other options.
+func checkStartupPolicy(options Options) error {
+	switch options.StartupPolicy {
+	case startupPolicyFail, startupPolicyEmpty:
+		return nil
+	case startupPolicyCache:
+		if options.SecretCache.AllowStale <= 0 {
+			return fmt.Errorf("-startup-timeout-policy %s requires -allow-stale", startupPolicyCache)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid startup timeout policy %s, must be one of: %s", options.StartupPolicy, strings.Join(startupPolicies, ", "))
+}
+
+// startupTimeoutSecrets returns the secrets to run the command with once the
+// startup deadline has passed, or err if it shouldn't be run.
+func startupTimeoutSecrets(flagConfig vaultexec.VaultConfig, options Options, err error) (vaultexec.VaultSecrets, error) {
+	switch options.StartupPolicy {
+	case startupPolicyCache:
+		// The cache is only used for the paths given as options, since any
+		// that would be generated aren't known yet.
+		config, configErr := vaultexec.NewVaultConfig(flagConfig)
+		if configErr != nil {
+			return vaultexec.VaultSecrets{}, fmt.Errorf("%s, and the cached secrets can't be used: %s", err, configErr)
+		}
+
+		vaultSecrets, fetchedAt, cacheErr := vaultexec.GetCachedVaultSecrets(config, options.SecretCache)
+		if cacheErr != nil {
+			return vaultSecrets, fmt.Errorf("%s, and the cached secrets can't be used: %s", err, cacheErr)
+		}
+
+		vaultexec.LogWarnf("Startup %s, running the command with secrets cached %s ago", err, time.Since(fetchedAt).Round(time.Second))
+		return vaultSecrets, nil
+	case startupPolicyEmpty:
+		vaultexec.LogWarnf("Startup %s, running the command without secrets", err)
+		return vaultexec.VaultSecrets{
+			Values:  map[string]interface{}{},
+			Sources: map[string]string{},
+		}, nil
+	}
+
+	return vaultexec.VaultSecrets{}, err
+}
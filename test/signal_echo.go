@@ -10,7 +10,7 @@ import (
 )
 
 func main() {
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 
 	signal.Notify(
 		sigs,
@@ -0,0 +1,225 @@
+package main
+
+// yaml.go includes a parser for the subset of YAML used by config files: block
+// mappings, block sequences, scalars (plain or quoted), and comments.  Flow
+// collections ({...} and [...]), anchors, tags, and multi-line scalars are not
+// supported.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a single meaningful (non-blank, non-comment) line of a document.
+type yamlLine struct {
+	number int // 1-based line number in the document
+	indent int
+	text   string
+}
+
+// parseYAML parses a YAML document into maps, slices, and string scalars,
+// along with the line number of every key in a mapping by its dotted path
+// (e.g. profiles.staging.address).
+func parseYAML(document []byte) (map[string]interface{}, map[string]int, error) {
+	var lines []yamlLine
+
+	for i, text := range strings.Split(string(document), "\n") {
+		text = stripYAMLComment(strings.TrimRight(text, " \t\r"))
+		trimmed := strings.TrimLeft(text, " ")
+
+		if len(trimmed) == 0 || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+
+		lines = append(lines, yamlLine{number: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+
+	keyLines := map[string]int{}
+
+	if len(lines) == 0 {
+		return map[string]interface{}{}, keyLines, nil
+	}
+
+	value, next, err := parseYAMLBlock(lines, 0, lines[0].indent, "", keyLines)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if next < len(lines) {
+		return nil, nil, fmt.Errorf("line %d: unexpected indentation", lines[next].number)
+	}
+
+	mapping, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("line %d: document must be a mapping", lines[0].number)
+	}
+
+	return mapping, keyLines, nil
+}
+
+// parseYAMLBlock parses the mapping or sequence starting at lines[start] whose
+// entries are all at the given indentation, returning the index of the first
+// line after it.  The line of every key is recorded in keyLines, prefixed by
+// the dotted path of the block.
+func parseYAMLBlock(lines []yamlLine, start int, indent int, prefix string, keyLines map[string]int) (interface{}, int, error) {
+	if strings.HasPrefix(lines[start].text, "- ") || lines[start].text == "-" {
+		return parseYAMLSequence(lines, start, indent)
+	}
+	return parseYAMLMapping(lines, start, indent, prefix, keyLines)
+}
+
+func parseYAMLMapping(lines []yamlLine, start int, indent int, prefix string, keyLines map[string]int) (interface{}, int, error) {
+	mapping := map[string]interface{}{}
+
+	i := start
+	for i < len(lines) && lines[i].indent == indent {
+		line := lines[i]
+
+		key, rest, err := splitYAMLKey(line)
+		if err != nil {
+			return nil, i, err
+		}
+
+		if _, exists := mapping[key]; exists {
+			return nil, i, fmt.Errorf("line %d: duplicate key %q", line.number, key)
+		}
+		keyLines[prefix+key] = line.number
+
+		i++
+
+		if len(rest) > 0 {
+			mapping[key], err = parseYAMLScalar(rest, line.number)
+			if err != nil {
+				return nil, i, err
+			}
+			continue
+		}
+
+		// A key with no value is followed by a nested block, or is empty.
+		if i < len(lines) && lines[i].indent > indent {
+			mapping[key], i, err = parseYAMLBlock(lines, i, lines[i].indent, prefix+key+".", keyLines)
+			if err != nil {
+				return nil, i, err
+			}
+		} else if i < len(lines) && lines[i].indent == indent && strings.HasPrefix(lines[i].text, "-") {
+			// Sequences are commonly written at the same indentation as their key.
+			mapping[key], i, err = parseYAMLSequence(lines, i, indent)
+			if err != nil {
+				return nil, i, err
+			}
+		} else {
+			mapping[key] = ""
+		}
+	}
+
+	if i < len(lines) && lines[i].indent > indent {
+		return nil, i, fmt.Errorf("line %d: unexpected indentation", lines[i].number)
+	}
+
+	return mapping, i, nil
+}
+
+func parseYAMLSequence(lines []yamlLine, start int, indent int) (interface{}, int, error) {
+	sequence := []interface{}{}
+
+	i := start
+	for i < len(lines) && lines[i].indent == indent && strings.HasPrefix(lines[i].text, "-") {
+		line := lines[i]
+		item := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+
+		if len(item) == 0 {
+			return nil, i, fmt.Errorf("line %d: nested sequence items are not supported", line.number)
+		}
+
+		value, err := parseYAMLScalar(item, line.number)
+		if err != nil {
+			return nil, i, err
+		}
+
+		sequence = append(sequence, value)
+		i++
+	}
+
+	return sequence, i, nil
+}
+
+// splitYAMLKey splits a "key: value" line into its key and (possibly empty)
+// value.
+func splitYAMLKey(line yamlLine) (string, string, error) {
+	var key, rest string
+
+	if strings.HasPrefix(line.text, `"`) || strings.HasPrefix(line.text, "'") {
+		end := strings.Index(line.text[1:], line.text[:1])
+		if end < 0 {
+			return "", "", fmt.Errorf("line %d: unterminated quoted key", line.number)
+		}
+		key = line.text[1 : end+1]
+		rest = line.text[end+2:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("line %d: expected \"key: value\"", line.number)
+		}
+		rest = rest[1:]
+	} else {
+		separator := strings.Index(line.text, ": ")
+		if separator < 0 && strings.HasSuffix(line.text, ":") {
+			separator = len(line.text) - 1
+		}
+		if separator <= 0 {
+			return "", "", fmt.Errorf("line %d: expected \"key: value\"", line.number)
+		}
+		key = line.text[:separator]
+		rest = line.text[separator+1:]
+	}
+
+	return strings.TrimSpace(key), strings.TrimSpace(rest), nil
+}
+
+// parseYAMLScalar parses a plain or quoted scalar value.
+func parseYAMLScalar(value string, lineNumber int) (interface{}, error) {
+	if strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[") {
+		return nil, fmt.Errorf("line %d: flow collections are not supported", lineNumber)
+	}
+
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid double quoted string", lineNumber)
+		}
+		return unquoted, nil
+	}
+
+	if strings.HasPrefix(value, "'") {
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return nil, fmt.Errorf("line %d: invalid single quoted string", lineNumber)
+		}
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+	}
+
+	return value, nil
+}
+
+// stripYAMLComment removes a trailing comment from a line, ignoring any "#"
+// inside quotes or not preceded by whitespace.
+func stripYAMLComment(line string) string {
+	var quote rune
+
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || line[i-1] == ' '):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+
+	return line
+}